@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sidalsoft/crud/pkg/managers"
+	"github.com/sidalsoft/crud/pkg/security"
+	"go.uber.org/dig"
+	"os"
+	"strings"
+)
+
+const adminUsage = `usage: crud admin create-manager -name NAME -phone PHONE [-roles ROLE,ROLE]
+
+Пароль берётся из ADMIN_PASSWORD, иначе читается первой строкой из stdin.
+Менеджер всегда получает роль ADMIN, -roles добавляет к ней другие роли.`
+
+//runAdmin выполняет служебные команды crud admin
+func runAdmin(args []string, container *dig.Container) error {
+	if len(args) == 0 {
+		return errors.New(adminUsage)
+	}
+	switch args[0] {
+	case "create-manager":
+		return createManager(args[1:], container)
+	default:
+		return errors.New(adminUsage)
+	}
+}
+
+//createManager создаёт администратора напрямую в базе, например когда менеджеров ещё нет
+func createManager(args []string, container *dig.Container) error {
+	flags := flag.NewFlagSet("create-manager", flag.ContinueOnError)
+	name := flags.String("name", "", "manager name")
+	phone := flags.String("phone", "", "manager phone, used as login")
+	roles := flags.String("roles", "", "additional roles, comma separated")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" || *phone == "" {
+		return errors.New(adminUsage)
+	}
+	pass, err := readAdminPassword()
+	if err != nil {
+		return err
+	}
+
+	item := &managers.Managers{Name: *name, Phone: *phone, Password: pass}
+	if *roles != "" {
+		item.Roles = strings.Split(*roles, ",")
+	}
+	return container.Invoke(func(managerSvc *managers.ManagersService, auditSvc *security.AuditService) error {
+		manager, err := managerSvc.CreateAdmin(context.Background(), item)
+		event := &security.AuditEvent{
+			Action:     security.AuditManagerBootstrap,
+			TargetKind: security.KindManager,
+			TargetID:   *phone,
+			Details:    "crud admin create-manager",
+		}
+		if err != nil {
+			event.Outcome = security.AuditFailure
+			event.Details += ": " + err.Error()
+		}
+		auditSvc.Record(context.Background(), event)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("manager %d created with roles %s\n", manager.ID, strings.Join(manager.Roles, ","))
+		return nil
+	})
+}
+
+func readAdminPassword() (string, error) {
+	if pass, ok := os.LookupEnv("ADMIN_PASSWORD"); ok {
+		return pass, nil
+	}
+	fmt.Fprint(os.Stderr, "password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", errors.New("password required")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
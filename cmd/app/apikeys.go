@@ -0,0 +1,177 @@
+package app
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/sidalsoft/crud/cmd/app/middleware"
+	"github.com/sidalsoft/crud/pkg/security"
+	"net/http"
+	"strconv"
+)
+
+//errAPIKeyNotAllowed ключ запрошен для чужого владельца или с правами, которых нет у выпускающего
+var errAPIKeyNotAllowed = errors.New("api key owner or scopes not allowed")
+
+//writeAPIKeyError переводит ошибки API-ключей и клиентских сертификатов в HTTP-ответы
+func writeAPIKeyError(writer http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, security.ErrInvalidAPIKey), errors.Is(err, security.ErrInvalidAllowedIP),
+		errors.Is(err, security.ErrUnknownPermission), errors.Is(err, security.ErrNoSuchUser),
+		errors.Is(err, security.ErrInvalidCertificate):
+		status = http.StatusBadRequest
+	case errors.Is(err, security.ErrNoSuchAPIKey), errors.Is(err, security.ErrNoSuchCertificate):
+		status = http.StatusNotFound
+	case errors.Is(err, security.ErrCertificateSubjectUsed):
+		status = http.StatusConflict
+	}
+	if status == http.StatusInternalServerError {
+		writeFail(writer, status, err)
+		return
+	}
+	parceErrJSON(writer, struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}{Status: "fail", Reason: err.Error()}, status)
+}
+
+//apiKeyManager находит менеджера-владельца API-ключа
+func (s *Server) apiKeyManager(ctx context.Context, key string, client *security.Client) (*middleware.Principal, error) {
+	item, err := s.apiKeySvc.Authenticate(ctx, key, client)
+	if err != nil {
+		return nil, err
+	}
+	return &middleware.Principal{ID: item.OwnerID, Kind: security.KindManager, APIKeyID: item.ID, Scopes: item.Scopes}, nil
+}
+
+func (s *Server) handleGetAPIKeys(writer http.ResponseWriter, request *http.Request) {
+	items, err := s.apiKeySvc.All(request.Context())
+	if err != nil {
+		writeAPIKeyError(writer, err)
+		return
+	}
+	parceJSON(writer, items)
+}
+
+//canIssueAPIKey ключ не может дать больше прав, чем есть у того, кто его выпускает,
+//а выпустить ключ от имени другого менеджера может только администратор ключей
+func (s *Server) canIssueAPIKey(request *http.Request, callerID int64, key *security.APIKey) (bool, error) {
+	if key.OwnerID != callerID {
+		ok, err := middleware.HasPermission(request.Context(), s.managerSvc.Permissions, security.PermAPIKeysAdmin)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	for _, scope := range key.Scopes {
+		ok, err := middleware.HasPermission(request.Context(), s.managerSvc.Permissions, scope)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+//handleCreateAPIKey выпускает ключ. Ключ есть только в этом ответе, потом его не восстановить
+func (s *Server) handleCreateAPIKey(writer http.ResponseWriter, request *http.Request) {
+	var data *security.APIKey
+	err := json.NewDecoder(request.Body).Decode(&data)
+	if err != nil || data == nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	callerID, err := middleware.Authentication(request.Context())
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if data.OwnerID == 0 {
+		data.OwnerID = callerID
+	}
+	ok, err := s.canIssueAPIKey(request, callerID, data)
+	if err != nil {
+		writeFail(writer, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		s.audit(request, security.AuditAPIKeyCreate, security.AuditTargetAPIKey, "", errAPIKeyNotAllowed)
+		http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	item, err := s.apiKeySvc.Create(request.Context(), data)
+	if err != nil {
+		s.audit(request, security.AuditAPIKeyCreate, security.AuditTargetAPIKey, "", err)
+		writeAPIKeyError(writer, err)
+		return
+	}
+	s.audit(request, security.AuditAPIKeyCreate, security.AuditTargetAPIKey, strconv.FormatInt(item.ID, 10), nil)
+	parceErrJSON(writer, item, http.StatusCreated)
+}
+
+func (s *Server) handleRevokeAPIKey(writer http.ResponseWriter, request *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(request)["id"], 10, 64)
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	item, err := s.apiKeySvc.Revoke(request.Context(), id)
+	s.audit(request, security.AuditAPIKeyRevoke, security.AuditTargetAPIKey, mux.Vars(request)["id"], err)
+	if err != nil {
+		writeAPIKeyError(writer, err)
+		return
+	}
+	parceJSON(writer, item)
+}
+
+//certificateManager находит менеджера по субъекту клиентского сертификата
+func (s *Server) certificateManager(ctx context.Context, certificate *x509.Certificate, client *security.Client) (*middleware.Principal, error) {
+	identity, err := s.certificateSvc.Authenticate(ctx, certificate.Subject.CommonName, client)
+	if err != nil {
+		return nil, err
+	}
+	return &middleware.Principal{ID: identity.ManagerID, Kind: security.KindManager, APIKeyID: identity.APIKeyID,
+		Scopes: identity.Scopes, CertificateID: identity.CertificateID}, nil
+}
+
+func (s *Server) handleGetClientCertificates(writer http.ResponseWriter, request *http.Request) {
+	items, err := s.certificateSvc.All(request.Context())
+	if err != nil {
+		writeAPIKeyError(writer, err)
+		return
+	}
+	parceJSON(writer, items)
+}
+
+//handleBindClientCertificate привязывает CommonName сертификата к менеджеру или API-ключу
+func (s *Server) handleBindClientCertificate(writer http.ResponseWriter, request *http.Request) {
+	var data *security.ClientCertificate
+	err := json.NewDecoder(request.Body).Decode(&data)
+	if err != nil || data == nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	item, err := s.certificateSvc.Bind(request.Context(), data)
+	s.audit(request, security.AuditCertificateBind, security.AuditTargetCertificate, data.Subject, err)
+	if err != nil {
+		writeAPIKeyError(writer, err)
+		return
+	}
+	parceErrJSON(writer, item, http.StatusCreated)
+}
+
+func (s *Server) handleRevokeClientCertificate(writer http.ResponseWriter, request *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(request)["id"], 10, 64)
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	item, err := s.certificateSvc.Revoke(request.Context(), id)
+	s.audit(request, security.AuditCertificateRevoke, security.AuditTargetCertificate, mux.Vars(request)["id"], err)
+	if err != nil {
+		writeAPIKeyError(writer, err)
+		return
+	}
+	parceJSON(writer, item)
+}
@@ -0,0 +1,111 @@
+package app
+
+import (
+	"context"
+	"github.com/sidalsoft/crud/cmd/app/middleware"
+	"github.com/sidalsoft/crud/pkg/security"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//audit записывает событие от имени пользователя запроса. err != nil означает неудачную попытку.
+//Запись идёт не в контексте запроса: клиент, оборвавший соединение, не должен избежать журнала
+func (s *Server) audit(request *http.Request, action string, targetKind string, targetID string, err error) {
+	client := clientFrom(request)
+	event := &security.AuditEvent{
+		Action:     action,
+		TargetKind: targetKind,
+		TargetID:   targetID,
+		IP:         client.IP,
+		UserAgent:  client.UserAgent,
+	}
+	if principal, perr := middleware.PrincipalFrom(request.Context()); perr == nil {
+		id := principal.ID
+		event.ActorKind = principal.Kind
+		event.ActorID = &id
+		switch {
+		case principal.CertificateID != 0:
+			event.Details = "client certificate " + strconv.FormatInt(principal.CertificateID, 10)
+		case principal.APIKeyID != 0:
+			event.Details = "api key " + strconv.FormatInt(principal.APIKeyID, 10)
+		}
+	}
+	s.record(event, err)
+}
+
+//auditLogin записывает попытку входа: пользователь ещё не известен, объект - телефон
+func (s *Server) auditLogin(request *http.Request, action string, kind string, phone string, err error) {
+	client := clientFrom(request)
+	s.record(&security.AuditEvent{
+		ActorKind:  kind,
+		Action:     action,
+		TargetKind: kind,
+		TargetID:   phone,
+		IP:         client.IP,
+		UserAgent:  client.UserAgent,
+	}, err)
+}
+
+func (s *Server) record(event *security.AuditEvent, err error) {
+	if err != nil {
+		event.Outcome = security.AuditFailure
+		event.Details = err.Error()
+	}
+	s.auditSvc.Record(context.Background(), event)
+}
+
+//handleGetAuditEvents журнал аудита,
+//?actorKind=&actorId=&action=&targetKind=&targetId=&outcome=&from=&to=&limit=&offset=, from и to в RFC 3339
+func (s *Server) handleGetAuditEvents(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	filter := &security.AuditFilter{
+		ActorKind:  query.Get("actorKind"),
+		Action:     query.Get("action"),
+		TargetKind: query.Get("targetKind"),
+		TargetID:   query.Get("targetId"),
+		Outcome:    query.Get("outcome"),
+	}
+	var err error
+	if value := query.Get("actorId"); value != "" {
+		filter.ActorID, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+	for name, target := range map[string]**time.Time{"from": &filter.From, "to": &filter.To} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		moment, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		moment = moment.UTC()
+		*target = &moment
+	}
+	filter.Limit, filter.Offset, err = pageParams(query)
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	items, err := s.auditSvc.Events(request.Context(), filter)
+	if err != nil {
+		writeFail(writer, http.StatusInternalServerError, err)
+		return
+	}
+	parceJSON(writer, items)
+}
+
+//handleVerifyAuditEvents проверяет, что цепочка хэшей журнала не нарушена
+func (s *Server) handleVerifyAuditEvents(writer http.ResponseWriter, request *http.Request) {
+	result, err := s.auditSvc.Verify(request.Context())
+	if err != nil {
+		writeFail(writer, http.StatusInternalServerError, err)
+		return
+	}
+	parceJSON(writer, result)
+}
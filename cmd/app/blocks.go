@@ -0,0 +1,96 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/sidalsoft/crud/pkg/security"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//blockActions действия аудита для блокировки и разблокировки каждого вида пользователей
+var blockActions = map[string][2]string{
+	security.KindCustomer: {security.AuditCustomerBlock, security.AuditCustomerUnblock},
+	security.KindManager:  {security.AuditManagerBlock, security.AuditManagerUnblock},
+}
+
+//writeBlockError переводит ошибки блокировки в HTTP-ответы
+func writeBlockError(writer http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, security.ErrInvalidBlock):
+		status = http.StatusBadRequest
+	case errors.Is(err, security.ErrNoSuchUser):
+		status = http.StatusNotFound
+	}
+	if status == http.StatusInternalServerError {
+		writeFail(writer, status, err)
+		return
+	}
+	parceErrJSON(writer, struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}{Status: "fail", Reason: err.Error()}, status)
+}
+
+//writeBlockedError отвечает 403 заблокированному пользователю с причиной и сроком блокировки
+func writeBlockedError(writer http.ResponseWriter, blocked *security.BlockedError) {
+	parceErrJSON(writer, struct {
+		Status      string     `json:"status"`
+		Reason      string     `json:"reason"`
+		BlockReason string     `json:"blockReason,omitempty"`
+		Until       *time.Time `json:"until,omitempty"`
+	}{Status: "fail", Reason: blocked.Error(), BlockReason: blocked.Reason, Until: blocked.Until}, http.StatusForbidden)
+}
+
+//handleBlock блокирует пользователя и завершает его сессии.
+//Тело необязательно: {"reason": "...", "until": "RFC 3339"}, без until блокировка бессрочная
+func (s *Server) handleBlock(kind string) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		idParam := mux.Vars(request)["id"]
+		id, err := strconv.ParseInt(idParam, 10, 64)
+		if err != nil {
+			http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		data := struct {
+			Reason string     `json:"reason"`
+			Until  *time.Time `json:"until"`
+		}{}
+		if request.ContentLength != 0 {
+			err = json.NewDecoder(request.Body).Decode(&data)
+			if err != nil {
+				http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+		}
+		item, err := s.blockSvc.Block(request.Context(), kind, id, data.Reason, data.Until)
+		s.audit(request, blockActions[kind][0], kind, idParam, err)
+		if err != nil {
+			writeBlockError(writer, err)
+			return
+		}
+		parceJSON(writer, item)
+	})
+}
+
+//handleUnblock снимает блокировку
+func (s *Server) handleUnblock(kind string) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		idParam := mux.Vars(request)["id"]
+		id, err := strconv.ParseInt(idParam, 10, 64)
+		if err != nil {
+			http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		item, err := s.blockSvc.Unblock(request.Context(), kind, id)
+		s.audit(request, blockActions[kind][1], kind, idParam, err)
+		if err != nil {
+			writeBlockError(writer, err)
+			return
+		}
+		parceJSON(writer, item)
+	})
+}
@@ -0,0 +1,121 @@
+package app
+
+import (
+	"github.com/sidalsoft/crud/pkg/customers"
+	"github.com/sidalsoft/crud/pkg/managers"
+	"time"
+)
+
+//Модели запросов и ответов API. Пароль есть только во входных моделях:
+//ответы собираются из выходных моделей, поэтому хэш пароля не может попасть клиенту
+
+//customerRequest регистрация покупателя. id в запросе нет: существующие покупатели так не меняются
+type customerRequest struct {
+	Name     string `json:"name"`
+	Phone    string `json:"phone"`
+	Password string `json:"password"`
+}
+
+func (r *customerRequest) model() *customers.Customer {
+	return &customers.Customer{Name: r.Name, Phone: r.Phone, Password: r.Password}
+}
+
+//customerResponse покупатель в ответе
+type customerResponse struct {
+	ID      int64     `json:"id"`
+	Name    string    `json:"name"`
+	Phone   string    `json:"phone"`
+	Active  bool      `json:"active"`
+	Created time.Time `json:"created"`
+}
+
+func newCustomerResponse(item *customers.Customer) *customerResponse {
+	return &customerResponse{ID: item.ID, Name: item.Name, Phone: item.Phone, Active: item.Active, Created: item.Created}
+}
+
+func newCustomerResponses(items []*customers.Customer) []*customerResponse {
+	result := make([]*customerResponse, 0, len(items))
+	for _, item := range items {
+		result = append(result, newCustomerResponse(item))
+	}
+	return result
+}
+
+//customerPageResponse страница списка покупателей
+type customerPageResponse struct {
+	Items  []*customerResponse `json:"items"`
+	Total  int64               `json:"total"`
+	Limit  int                 `json:"limit"`
+	Offset int                 `json:"offset"`
+}
+
+func newCustomerPageResponse(page *customers.Page) *customerPageResponse {
+	return &customerPageResponse{
+		Items:  newCustomerResponses(page.Items),
+		Total:  page.Total,
+		Limit:  page.Limit,
+		Offset: page.Offset,
+	}
+}
+
+//managerRequest менеджер во входящем запросе
+type managerRequest struct {
+	Name       string   `json:"name"`
+	Salary     int      `json:"salary"`
+	Plan       int      `json:"plan"`
+	BossId     *int64   `json:"bossId"`
+	Department string   `json:"department"`
+	Phone      string   `json:"phone"`
+	Password   string   `json:"password"`
+	Roles      []string `json:"roles"`
+}
+
+func (r *managerRequest) model() *managers.Managers {
+	return &managers.Managers{
+		Name:       r.Name,
+		Salary:     r.Salary,
+		Plan:       r.Plan,
+		BossId:     r.BossId,
+		Department: r.Department,
+		Phone:      r.Phone,
+		Password:   r.Password,
+		Roles:      r.Roles,
+	}
+}
+
+//managerResponse менеджер в ответе
+type managerResponse struct {
+	ID         int64     `json:"id"`
+	Name       string    `json:"name"`
+	Salary     int       `json:"salary"`
+	Plan       int       `json:"plan"`
+	BossId     *int64    `json:"bossId"`
+	Department string    `json:"department"`
+	Phone      string    `json:"phone"`
+	Roles      []string  `json:"roles"`
+	Active     bool      `json:"active"`
+	Created    time.Time `json:"created"`
+}
+
+func newManagerResponse(item *managers.Managers) *managerResponse {
+	return &managerResponse{
+		ID:         item.ID,
+		Name:       item.Name,
+		Salary:     item.Salary,
+		Plan:       item.Plan,
+		BossId:     item.BossId,
+		Department: item.Department,
+		Phone:      item.Phone,
+		Roles:      item.Roles,
+		Active:     item.Active,
+		Created:    item.Created,
+	}
+}
+
+func newManagerResponses(items []*managers.Managers) []*managerResponse {
+	result := make([]*managerResponse, 0, len(items))
+	for _, item := range items {
+		result = append(result, newManagerResponse(item))
+	}
+	return result
+}
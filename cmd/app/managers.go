@@ -2,78 +2,398 @@ package app
 
 import (
 	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
 	"github.com/sidalsoft/crud/cmd/app/middleware"
+	"github.com/sidalsoft/crud/pkg/customers"
 	"github.com/sidalsoft/crud/pkg/managers"
 	"github.com/sidalsoft/crud/pkg/products"
-	"github.com/sidalsoft/crud/pkg/salePositions"
 	"github.com/sidalsoft/crud/pkg/sales"
+	"github.com/sidalsoft/crud/pkg/security"
+	"log"
 	"net/http"
-	"time"
+	"strconv"
+	"strings"
 )
 
+//canAssignRoles назначать роли, кроме роли по умолчанию, может только тот, кто управляет ролями
+func (s *Server) canAssignRoles(request *http.Request, roles []string) (bool, error) {
+	for _, role := range roles {
+		if !strings.EqualFold(role, security.RoleManager) {
+			return middleware.HasPermission(request.Context(), s.managerSvc.Permissions, security.PermRolesWrite)
+		}
+	}
+	return true, nil
+}
+
+//writeManagerError переводит ошибки управления менеджерами в HTTP-ответы
+func writeManagerError(writer http.ResponseWriter, err error) {
+	if writePolicyError(writer, err) {
+		return
+	}
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, managers.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, managers.ErrInvalidBoss), errors.Is(err, managers.ErrInvalidManager),
+		errors.Is(err, security.ErrUnknownRole):
+		status = http.StatusBadRequest
+	case errors.Is(err, managers.ErrPhoneTaken):
+		status = http.StatusConflict
+	}
+	if status == http.StatusInternalServerError {
+		writeFail(writer, status, err)
+		return
+	}
+	parceErrJSON(writer, struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}{Status: "fail", Reason: err.Error()}, status)
+}
+
+//handleGetManagers все менеджеры
+func (s *Server) handleGetManagers(writer http.ResponseWriter, request *http.Request) {
+	items, err := s.managerSvc.All(request.Context())
+	if err != nil {
+		writeManagerError(writer, err)
+		return
+	}
+	parceJSON(writer, newManagerResponses(items))
+}
+
+func (s *Server) handleGetManagerByID(writer http.ResponseWriter, request *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(request)["id"], 10, 64)
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	item, err := s.managerSvc.ByID(request.Context(), id)
+	if err != nil {
+		writeManagerError(writer, err)
+		return
+	}
+	parceJSON(writer, newManagerResponse(item))
+}
+
+//handleUpdateManager меняет данные менеджера: имя, телефон, зарплату, план, руководителя и отдел.
+//Роли меняются, только если переданы, пароль здесь не меняется
+func (s *Server) handleUpdateManager(writer http.ResponseWriter, request *http.Request) {
+	idParam := mux.Vars(request)["id"]
+	id, err := strconv.ParseInt(idParam, 10, 64)
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	data := &managerRequest{}
+	err = json.NewDecoder(request.Body).Decode(data)
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	ok, err := s.canAssignRoles(request, data.Roles)
+	if err != nil {
+		writeFail(writer, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	current, err := s.managerSvc.ByID(request.Context(), id)
+	if err != nil {
+		writeManagerError(writer, err)
+		return
+	}
+	manager := data.model()
+	manager.ID = id
+	manager.Password = ""
+	//непереданные роли и нулевые зарплата и план остаются прежними, проверяется менеджер с ними
+	if len(manager.Roles) == 0 {
+		manager.Roles = current.Roles
+	}
+	if manager.Salary == 0 {
+		manager.Salary = current.Salary
+	}
+	if manager.Plan == 0 {
+		manager.Plan = current.Plan
+	}
+	if err := manager.Validate(); err != nil {
+		writeManagerError(writer, err)
+		return
+	}
+	item, err := s.managerSvc.Save(request.Context(), manager)
+	s.audit(request, security.AuditManagerUpdate, security.KindManager, idParam, err)
+	if err != nil {
+		writeManagerError(writer, err)
+		return
+	}
+	parceJSON(writer, newManagerResponse(item))
+}
+
+//handleManagerPatchManager частично меняет менеджера по JSON Merge Patch (RFC 7396).
+//null допустим только в bossId и снимает руководителя, изменение ролей требует права на управление ролями
+func (s *Server) handleManagerPatchManager(writer http.ResponseWriter, request *http.Request) {
+	idParam := mux.Vars(request)["id"]
+	id, err := strconv.ParseInt(idParam, 10, 64)
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	patch, err := readMergePatch(writer, request)
+	if err != nil {
+		writePatchError(writer, err)
+		return
+	}
+	current, err := s.managerSvc.ByID(request.Context(), id)
+	if err != nil {
+		writeManagerError(writer, err)
+		return
+	}
+	doc := &struct {
+		Name       string   `json:"name"`
+		Phone      string   `json:"phone"`
+		Salary     int      `json:"salary"`
+		Plan       int      `json:"plan"`
+		BossId     *int64   `json:"bossId"`
+		Department string   `json:"department"`
+		Roles      []string `json:"roles"`
+	}{
+		Name:       current.Name,
+		Phone:      current.Phone,
+		Salary:     current.Salary,
+		Plan:       current.Plan,
+		BossId:     current.BossId,
+		Department: current.Department,
+		Roles:      current.Roles,
+	}
+	if err := mergePatch(doc, patch, "bossId"); err != nil {
+		if !writePatchError(writer, err) {
+			writeManagerError(writer, err)
+		}
+		return
+	}
+
+	manager := &managers.Managers{
+		ID:         id,
+		Name:       doc.Name,
+		Phone:      doc.Phone,
+		Salary:     doc.Salary,
+		Plan:       doc.Plan,
+		BossId:     doc.BossId,
+		Department: doc.Department,
+		Roles:      doc.Roles,
+	}
+	if err := manager.Validate(); err != nil {
+		writeManagerError(writer, err)
+		return
+	}
+	if !sameRoles(current.Roles, manager.Roles) {
+		ok, err := middleware.HasPermission(request.Context(), s.managerSvc.Permissions, security.PermRolesWrite)
+		if err != nil {
+			writeFail(writer, http.StatusInternalServerError, err)
+			return
+		}
+		if !ok {
+			http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+	item, err := s.managerSvc.Save(request.Context(), manager)
+	s.audit(request, security.AuditManagerUpdate, security.KindManager, idParam, err)
+	if err != nil {
+		writeManagerError(writer, err)
+		return
+	}
+	parceJSON(writer, newManagerResponse(item))
+}
+
+//sameRoles совпадают ли наборы ролей без учёта порядка и регистра
+func sameRoles(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, role := range a {
+		found := false
+		for _, other := range b {
+			if strings.EqualFold(role, other) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+//handleChangeManagerActive включает или отключает менеджера, {"active": false} завершает все его сессии
+func (s *Server) handleChangeManagerActive(writer http.ResponseWriter, request *http.Request) {
+	idParam := mux.Vars(request)["id"]
+	id, err := strconv.ParseInt(idParam, 10, 64)
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	data := struct {
+		Active *bool `json:"active"`
+	}{}
+	err = json.NewDecoder(request.Body).Decode(&data)
+	if err != nil || data.Active == nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	item, err := s.managerSvc.ChangeActive(request.Context(), id, *data.Active)
+	action := security.AuditManagerBlock
+	if *data.Active {
+		action = security.AuditManagerUnblock
+	}
+	s.audit(request, action, security.KindManager, idParam, err)
+	if err != nil {
+		writeManagerError(writer, err)
+		return
+	}
+	parceJSON(writer, newManagerResponse(item))
+}
+
 func (s *Server) handleManagerRegistration(writer http.ResponseWriter, request *http.Request) {
-	var data *managers.Managers
-	err := json.NewDecoder(request.Body).Decode(&data)
+	data := &managerRequest{}
+	err := json.NewDecoder(request.Body).Decode(data)
 	if err != nil {
+		writeFail(writer, http.StatusBadRequest, err)
+		return
+	}
+	model := data.model()
+	if err := model.Validate(); err != nil {
+		writeManagerError(writer, err)
+		return
+	}
+	ok, err := s.canAssignRoles(request, data.Roles)
+	if err != nil {
+		writeFail(writer, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	manager, err := s.managerSvc.Save(request.Context(), model)
+	s.audit(request, security.AuditManagerRegister, security.KindManager, data.Phone, err)
+	if err != nil {
+		writeManagerError(writer, err)
+		return
+	}
+	//токены новый менеджер получает сам при входе, тому, кто его завёл, они не нужны
+	parceErrJSON(writer, newManagerResponse(manager), http.StatusCreated)
+}
+
+//handleManagerBootstrap создаёт первого администратора по токену, напечатанному при старте.
+//Токен одноразовый и работает, только пока в базе нет менеджеров
+func (s *Server) handleManagerBootstrap(writer http.ResponseWriter, request *http.Request) {
+	data := struct {
+		Token    string `json:"token"`
+		Name     string `json:"name"`
+		Phone    string `json:"phone"`
+		Password string `json:"password"`
+	}{}
+	err := json.NewDecoder(request.Body).Decode(&data)
+	if err != nil || data.Name == "" || data.Phone == "" {
 		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		println(http.StatusBadRequest)
-		println(err)
 		return
 	}
-	data.Active = true
-	data.Created = time.Now()
-	manager, err := s.managerSvc.Save(request.Context(), data)
+	if !s.bootstrap.Valid(data.Token) {
+		http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	manager, err := s.managerSvc.CreateFirstAdmin(request.Context(), &managers.Managers{
+		Name:     data.Name,
+		Phone:    data.Phone,
+		Password: data.Password,
+	})
+	s.auditLogin(request, security.AuditManagerBootstrap, security.KindManager, data.Phone, err)
+	if writePolicyError(writer, err) {
+		return
+	}
+	if errors.Is(err, managers.ErrAlreadyBootstrapped) {
+		s.bootstrap.Invalidate()
+		http.Error(writer, http.StatusText(http.StatusConflict), http.StatusConflict)
+		return
+	}
 	if err != nil {
-		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		println(http.StatusInternalServerError)
-		println(err)
+		writeFail(writer, http.StatusInternalServerError, err)
 		return
 	}
-	token, err := s.managerSvc.TokenForManager(request.Context(), manager.Phone, data.Password)
+	s.bootstrap.Invalidate()
+	token, err := s.managerSvc.TokenForManager(request.Context(), manager.Phone, data.Password, clientFrom(request))
 	if err != nil {
-		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		println(http.StatusText(http.StatusInternalServerError), err.Error())
+		writeLoginError(writer, err)
 		return
 	}
-	parceJSON(writer, struct {
-		Token string `json:"token"`
-	}{Token: token})
-	//parceJSON(writer, manager)
+	parceJSON(writer, token)
 }
 
 func (s *Server) handleManagerGetToken(writer http.ResponseWriter, request *http.Request) {
 	data := struct {
-		Login    string `json:"phone"`
-		Password string `json:"password"`
+		Login        string `json:"phone"`
+		Password     string `json:"password"`
+		Challenge    string `json:"challenge"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
 	}{}
 	err := json.NewDecoder(request.Body).Decode(&data)
 	if err != nil {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		println(http.StatusText(http.StatusBadRequest), err.Error())
+		writeFail(writer, http.StatusBadRequest, err)
 		return
 	}
-	token, err := s.managerSvc.TokenForManager(request.Context(), data.Login, data.Password)
+	//второй шаг входа: challenge из первого ответа и код из приложения или код восстановления
+	if data.Challenge != "" {
+		token, err := s.managerSvc.TokenForChallenge(request.Context(), data.Challenge, data.Code, data.RecoveryCode, clientFrom(request))
+		s.auditLogin(request, security.AuditLoginMFA, security.KindManager, "", err)
+		if err != nil {
+			writeMFAError(writer, err)
+			return
+		}
+		parceJSON(writer, token)
+		return
+	}
+	token, err := s.managerSvc.TokenForManager(request.Context(), data.Login, data.Password, clientFrom(request))
+	s.auditLogin(request, security.AuditLogin, security.KindManager, data.Login, err)
 	if err != nil {
-		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		println(http.StatusText(http.StatusInternalServerError), err.Error())
+		writeLoginError(writer, err)
 		return
 	}
-	parceJSON(writer, struct {
-		Token string `json:"token"`
-	}{Token: token})
+	parceJSON(writer, token)
 }
 
 func (s *Server) handleManagerGetSales(writer http.ResponseWriter, request *http.Request) {
 	managerId, err := middleware.Authentication(request.Context())
 	if err != nil {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		println(http.StatusText(http.StatusBadRequest), err.Error())
+		writeFail(writer, http.StatusBadRequest, err)
 		return
 	}
+	//продажи других менеджеров видны только с правом sales:read:all
+	if param := request.URL.Query().Get("manager_id"); param != "" {
+		id, err := strconv.ParseInt(param, 10, 64)
+		if err != nil {
+			http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if id != managerId {
+			ok, err := middleware.HasPermission(request.Context(), s.managerSvc.Permissions, security.PermSalesReadAll)
+			if err != nil {
+				writeFail(writer, http.StatusInternalServerError, err)
+				return
+			}
+			if !ok {
+				http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			managerId = id
+		}
+	}
 	total, err := s.saleSvc.TotalByManager(request.Context(), managerId)
 	if err != nil {
-		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		println(http.StatusText(http.StatusInternalServerError), err.Error())
+		writeFail(writer, http.StatusInternalServerError, err)
 		return
 	}
 	parceJSON(writer, struct {
@@ -85,65 +405,71 @@ func (s *Server) handleManagerGetSales(writer http.ResponseWriter, request *http
 func (s *Server) handleManagerMakeSale(writer http.ResponseWriter, request *http.Request) {
 	managerId, err := middleware.Authentication(request.Context())
 	if err != nil {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		println(http.StatusText(http.StatusBadRequest), err.Error())
+		writeFail(writer, http.StatusBadRequest, err)
 		return
 	}
 	data := struct {
-		Id         int64  `json:"id"`
 		CustomerId *int64 `json:"customer_id"`
 		Positions  []struct {
-			Id        int64  `json:"id"`
-			ProductId int64  `json:"product_id"`
-			Name      string `json:"name"`
-			Qty       int    `json:"qty"`
-			Price     int    `json:"price"`
+			ProductId     int64 `json:"product_id"`
+			Qty           int   `json:"qty"`
+			PriceOverride *int  `json:"price_override"`
 		} `json:"positions"`
 	}{}
 	err = json.NewDecoder(request.Body).Decode(&data)
 	if err != nil {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		println(http.StatusText(http.StatusBadRequest), err.Error())
+		writeFail(writer, http.StatusBadRequest, err)
 		return
 	}
+	positions := make([]*sales.CheckoutPosition, 0, len(data.Positions))
+	override := false
 	for _, position := range data.Positions {
-		product, err := s.productSvc.ByID(request.Context(), position.ProductId)
+		positions = append(positions, &sales.CheckoutPosition{
+			ProductId:     position.ProductId,
+			Qty:           position.Qty,
+			PriceOverride: position.PriceOverride,
+		})
+		override = override || position.PriceOverride != nil
+	}
+	if override {
+		ok, err := middleware.HasPermission(request.Context(), s.managerSvc.Permissions, security.PermSalesPriceOverride)
 		if err != nil {
-			http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			println(http.StatusText(http.StatusInternalServerError), err.Error())
+			writeFail(writer, http.StatusInternalServerError, err)
 			return
 		}
-		if product.Qty < position.Qty {
-			http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		if !ok {
+			http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 			return
 		}
 	}
-	saleData := &sales.Sales{
-		ID:         data.Id,
-		ManagerId:  managerId,
-		CustomerId: data.CustomerId,
+	sale, _, err := s.saleSvc.Checkout(request.Context(), managerId, data.CustomerId, positions)
+	var stockErr *sales.InsufficientStockError
+	if errors.As(err, &stockErr) {
+		parceErrJSON(writer, struct {
+			Status     string  `json:"status"`
+			Reason     string  `json:"reason"`
+			ProductIds []int64 `json:"product_ids"`
+		}{Status: "fail", Reason: "insufficient stock", ProductIds: stockErr.ProductIDs}, http.StatusConflict)
+		return
 	}
-	sale, err := s.saleSvc.Save(request.Context(), saleData)
-	if err != nil {
-		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		println(http.StatusText(http.StatusInternalServerError), err.Error())
+	if errors.Is(err, sales.ErrProductNotFound) || errors.Is(err, sales.ErrInvalidPosition) {
+		writeFail(writer, http.StatusBadRequest, err)
 		return
 	}
-	for _, position := range data.Positions {
-		salePositionData := &salePositions.SalePositions{
-			ID:        position.Id,
-			SaleId:    sale.ID,
-			ProductId: position.ProductId,
-			Name:      position.Name,
-			Price:     position.Price,
-			Qty:       position.Qty,
-		}
-		_, err := s.salePositionsSvc.Save(request.Context(), salePositionData)
-		if err != nil {
-			http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			println(http.StatusText(http.StatusInternalServerError), err.Error())
-			return
+	if errors.Is(err, sales.ErrCustomerNotFound) || errors.Is(err, sales.ErrCustomerBlocked) {
+		status := http.StatusNotFound
+		if errors.Is(err, sales.ErrCustomerBlocked) {
+			status = http.StatusBadRequest
 		}
+		parceErrJSON(writer, struct {
+			Status string `json:"status"`
+			Reason string `json:"reason"`
+		}{Status: "fail", Reason: err.Error()}, status)
+		return
+	}
+	if err != nil {
+		writeFail(writer, http.StatusInternalServerError, err)
+		return
 	}
 
 	parceJSON(writer, struct {
@@ -151,42 +477,318 @@ func (s *Server) handleManagerMakeSale(writer http.ResponseWriter, request *http
 	}{Id: sale.ID})
 }
 
+//handleManagerGetProducts список товаров,
+//?q=&active=&minPrice=&maxPrice=&minQty=&maxQty=&sort=&limit=&offset=, sort - поле или -поле по убыванию
 func (s *Server) handleManagerGetProducts(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	filter := &products.Filter{
+		Query: query.Get("q"),
+		Sort:  query.Get("sort"),
+	}
+	if value := query.Get("active"); value != "" {
+		active, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		filter.Active = &active
+	}
+	for name, target := range map[string]**int{
+		"minPrice": &filter.MinPrice,
+		"maxPrice": &filter.MaxPrice,
+		"minQty":   &filter.MinQty,
+		"maxQty":   &filter.MaxQty,
+	} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		*target = &number
+	}
+	var err error
+	filter.Limit, filter.Offset, err = pageParams(query)
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
 
+	page, err := s.productSvc.List(request.Context(), filter)
+	if errors.Is(err, products.ErrInvalidFilter) {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeFail(writer, http.StatusInternalServerError, err)
+		return
+	}
+	parceJSON(writer, page)
 }
 
+//handleManagerChangeProduct создаёт товар или меняет название, цену и остаток существующего.
+//Архивный товар остаётся в архиве, вернуть его в продажу можно только через /restore
 func (s *Server) handleManagerChangeProduct(writer http.ResponseWriter, request *http.Request) {
 	var data *products.Product
 	err := json.NewDecoder(request.Body).Decode(&data)
-	if err != nil {
+	if err != nil || data == nil {
 		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		println(err.Error())
 		return
 	}
-	data.Active = true
-	data.Created = time.Now()
 
 	product, err := s.productSvc.Save(request.Context(), data)
 	if err != nil {
-		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		println(err.Error())
+		writeFail(writer, http.StatusInternalServerError, err)
 		return
 	}
 	parceJSON(writer, product)
 }
 
+//handleManagerPatchProduct частично меняет товар по JSON Merge Patch (RFC 7396).
+//null не допускается ни в одном поле, проверяется товар после слияния. active патчем не меняется: для этого есть DELETE и /restore
+func (s *Server) handleManagerPatchProduct(writer http.ResponseWriter, request *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(request)["id"], 10, 64)
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	patch, err := readMergePatch(writer, request)
+	if err != nil {
+		writePatchError(writer, err)
+		return
+	}
+	current, err := s.productSvc.ByID(request.Context(), id)
+	if errors.Is(err, products.ErrNotFound) {
+		http.Error(writer, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeFail(writer, http.StatusInternalServerError, err)
+		return
+	}
+	doc := &struct {
+		Name  string `json:"name"`
+		Price int    `json:"price"`
+		Qty   int    `json:"qty"`
+	}{Name: current.Name, Price: current.Price, Qty: current.Qty}
+	if err := mergePatch(doc, patch); err != nil {
+		if !writePatchError(writer, err) {
+			writeFail(writer, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	item, err := s.productSvc.Update(request.Context(), &products.Product{
+		ID:    id,
+		Name:  doc.Name,
+		Price: doc.Price,
+		Qty:   doc.Qty,
+	})
+	switch {
+	case errors.Is(err, products.ErrNotFound):
+		http.Error(writer, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case errors.Is(err, products.ErrInvalidProduct):
+		parceErrJSON(writer, struct {
+			Status string `json:"status"`
+			Reason string `json:"reason"`
+		}{Status: "fail", Reason: err.Error()}, http.StatusBadRequest)
+		return
+	case err != nil:
+		writeFail(writer, http.StatusInternalServerError, err)
+		return
+	}
+	parceJSON(writer, item)
+}
+
+//handleManagerRemoveProductByID архивирует товар: удалить его нельзя, пока на него ссылаются продажи
 func (s *Server) handleManagerRemoveProductByID(writer http.ResponseWriter, request *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(request)["id"], 10, 64)
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	item, err := s.productSvc.Archive(request.Context(), id)
+	if errors.Is(err, products.ErrNotFound) {
+		http.Error(writer, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeFail(writer, http.StatusInternalServerError, err)
+		return
+	}
+	parceJSON(writer, item)
+}
 
+//handleManagerRestoreProduct возвращает архивный товар в продажу
+func (s *Server) handleManagerRestoreProduct(writer http.ResponseWriter, request *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(request)["id"], 10, 64)
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	item, err := s.productSvc.Restore(request.Context(), id)
+	if errors.Is(err, products.ErrNotFound) {
+		http.Error(writer, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeFail(writer, http.StatusInternalServerError, err)
+		return
+	}
+	parceJSON(writer, item)
 }
 
+//handleManagerGetCustomers список покупателей, ?q=&active=&limit=&offset=, q ищет по имени и телефону
 func (s *Server) handleManagerGetCustomers(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	filter := &customers.Filter{Query: query.Get("q")}
+	if value := query.Get("active"); value != "" {
+		active, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		filter.Active = &active
+	}
+	var err error
+	filter.Limit, filter.Offset, err = pageParams(query)
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
 
+	page, err := s.customerSvc.List(request.Context(), filter)
+	if err != nil {
+		writeCustomerError(writer, err)
+		return
+	}
+	parceJSON(writer, newCustomerPageResponse(page))
 }
 
+//handleManagerChangeCustomer без id создаёт покупателя, с id меняет только переданные поля.
+//Пустой или отсутствующий пароль при изменении оставляет текущий
 func (s *Server) handleManagerChangeCustomer(writer http.ResponseWriter, request *http.Request) {
+	data := struct {
+		ID       int64   `json:"id"`
+		Name     *string `json:"name"`
+		Phone    *string `json:"phone"`
+		Password *string `json:"password"`
+	}{}
+	err := json.NewDecoder(request.Body).Decode(&data)
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if data.Password != nil && *data.Password == "" {
+		data.Password = nil
+	}
 
+	if data.ID == 0 {
+		if data.Name == nil || data.Phone == nil || data.Password == nil {
+			http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		customer, err := s.customerSvc.Save(request.Context(), &customers.Customer{
+			Name:     *data.Name,
+			Phone:    *data.Phone,
+			Password: *data.Password,
+		})
+		targetID := ""
+		if err == nil {
+			targetID = strconv.FormatInt(customer.ID, 10)
+		}
+		s.audit(request, security.AuditCustomerCreate, security.KindCustomer, targetID, err)
+		if err != nil {
+			writeCustomerError(writer, err)
+			return
+		}
+		//войти покупатель сможет после подтверждения номера, как и при самостоятельной регистрации
+		err = s.customerSvc.SendPhoneVerification(request.Context(), customer.Phone)
+		if err != nil {
+			log.Println(err)
+		}
+		parceJSON(writer, newCustomerResponse(customer))
+		return
+	}
+
+	customer, err := s.customerSvc.Update(request.Context(), data.ID, &customers.Changes{
+		Name:     data.Name,
+		Phone:    data.Phone,
+		Password: data.Password,
+	})
+	s.audit(request, security.AuditCustomerUpdate, security.KindCustomer, strconv.FormatInt(data.ID, 10), err)
+	if err != nil {
+		writeCustomerError(writer, err)
+		return
+	}
+	parceJSON(writer, newCustomerResponse(customer))
 }
 
-func (s *Server) handleManagerRemoveCustomerByID(writer http.ResponseWriter, request *http.Request) {
+//handleManagerPatchCustomer частично меняет покупателя по JSON Merge Patch (RFC 7396).
+//null не допускается, в Update уходят только поля, которые патч действительно изменил
+func (s *Server) handleManagerPatchCustomer(writer http.ResponseWriter, request *http.Request) {
+	idParam := mux.Vars(request)["id"]
+	id, err := strconv.ParseInt(idParam, 10, 64)
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	patch, err := readMergePatch(writer, request)
+	if err != nil {
+		writePatchError(writer, err)
+		return
+	}
+	current, err := s.customerSvc.ByID(request.Context(), id)
+	if err != nil {
+		writeCustomerError(writer, err)
+		return
+	}
+	//пароль не читается из базы, поэтому в документе он есть, только если его передали в патче
+	doc := &struct {
+		Name     string  `json:"name"`
+		Phone    string  `json:"phone"`
+		Password *string `json:"password,omitempty"`
+	}{Name: current.Name, Phone: current.Phone}
+	if err := mergePatch(doc, patch); err != nil {
+		if !writePatchError(writer, err) {
+			writeCustomerError(writer, err)
+		}
+		return
+	}
+
+	changes := &customers.Changes{Password: doc.Password}
+	if doc.Name != current.Name {
+		changes.Name = &doc.Name
+	}
+	if doc.Phone != current.Phone {
+		changes.Phone = &doc.Phone
+	}
+	customer, err := s.customerSvc.Update(request.Context(), id, changes)
+	s.audit(request, security.AuditCustomerUpdate, security.KindCustomer, idParam, err)
+	if err != nil {
+		writeCustomerError(writer, err)
+		return
+	}
+	parceJSON(writer, newCustomerResponse(customer))
+}
 
+//handleManagerRemoveCustomerByID удаляет покупателя, а покупателя с продажами помечает удалённым
+func (s *Server) handleManagerRemoveCustomerByID(writer http.ResponseWriter, request *http.Request) {
+	idParam := mux.Vars(request)["id"]
+	id, err := strconv.ParseInt(idParam, 10, 64)
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	removal, err := s.customerSvc.Remove(request.Context(), id)
+	s.audit(request, security.AuditCustomerDelete, security.KindCustomer, idParam, err)
+	if err != nil {
+		writeCustomerError(writer, err)
+		return
+	}
+	parceJSON(writer, removal)
 }
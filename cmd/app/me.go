@@ -0,0 +1,179 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/sidalsoft/crud/cmd/app/middleware"
+	"github.com/sidalsoft/crud/pkg/customers"
+	"github.com/sidalsoft/crud/pkg/security"
+	"net/http"
+	"strconv"
+)
+
+//writeCustomerError переводит ошибки личного кабинета покупателя в HTTP-ответы
+func writeCustomerError(writer http.ResponseWriter, err error) {
+	if writePolicyError(writer, err) {
+		return
+	}
+	var locked *security.LockedError
+	if errors.As(err, &locked) {
+		writeLoginError(writer, err)
+		return
+	}
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, customers.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, customers.ErrInvalidName), errors.Is(err, customers.ErrInvalidPhone):
+		status = http.StatusBadRequest
+	case errors.Is(err, security.ErrInvalidPassword):
+		status = http.StatusForbidden
+	case errors.Is(err, customers.ErrDeletionRequested), errors.Is(err, customers.ErrPhoneTaken):
+		status = http.StatusConflict
+	}
+	if status == http.StatusInternalServerError {
+		writeFail(writer, status, err)
+		return
+	}
+	parceErrJSON(writer, struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}{Status: "fail", Reason: err.Error()}, status)
+}
+
+func (s *Server) handleGetMe(writer http.ResponseWriter, request *http.Request) {
+	customerId, err := middleware.Authentication(request.Context())
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	item, err := s.customerSvc.ByID(request.Context(), customerId)
+	if err != nil {
+		writeCustomerError(writer, err)
+		return
+	}
+	parceJSON(writer, newCustomerResponse(item))
+}
+
+func (s *Server) handleUpdateMe(writer http.ResponseWriter, request *http.Request) {
+	customerId, err := middleware.Authentication(request.Context())
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	data := struct {
+		Name string `json:"name"`
+	}{}
+	err = json.NewDecoder(request.Body).Decode(&data)
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	item, err := s.customerSvc.UpdateProfile(request.Context(), customerId, data.Name)
+	if err != nil {
+		writeCustomerError(writer, err)
+		return
+	}
+	parceJSON(writer, newCustomerResponse(item))
+}
+
+//handleChangeMyPassword меняет пароль, завершает все сессии и выдаёт новые токены текущему клиенту
+func (s *Server) handleChangeMyPassword(writer http.ResponseWriter, request *http.Request) {
+	customerId, err := middleware.Authentication(request.Context())
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	data := struct {
+		OldPassword string `json:"oldPassword"`
+		NewPassword string `json:"newPassword"`
+	}{}
+	err = json.NewDecoder(request.Body).Decode(&data)
+	if err != nil || data.NewPassword == "" {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	err = s.customerSvc.ChangePassword(request.Context(), customerId, data.OldPassword, data.NewPassword, clientFrom(request))
+	s.audit(request, security.AuditPasswordChange, security.KindCustomer, strconv.FormatInt(customerId, 10), err)
+	if err != nil {
+		writeCustomerError(writer, err)
+		return
+	}
+	token, err := s.sessionSvc.Create(request.Context(), security.KindCustomer, customerId, clientFrom(request))
+	if err != nil {
+		writeCustomerError(writer, err)
+		return
+	}
+	parceJSON(writer, token)
+}
+
+func (s *Server) handleGetMyPurchases(writer http.ResponseWriter, request *http.Request) {
+	customerId, err := middleware.Authentication(request.Context())
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	limit, offset, err := pageParams(request.URL.Query())
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	items, err := s.saleSvc.ByCustomer(request.Context(), customerId, limit, offset)
+	if err != nil {
+		writeCustomerError(writer, err)
+		return
+	}
+	parceJSON(writer, items)
+}
+
+func (s *Server) handleRequestMyDeletion(writer http.ResponseWriter, request *http.Request) {
+	customerId, err := middleware.Authentication(request.Context())
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	data := struct {
+		Reason string `json:"reason"`
+	}{}
+	if request.ContentLength != 0 {
+		err = json.NewDecoder(request.Body).Decode(&data)
+		if err != nil {
+			http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+	item, err := s.customerSvc.RequestDeletion(request.Context(), customerId, data.Reason)
+	if err != nil {
+		writeCustomerError(writer, err)
+		return
+	}
+	parceErrJSON(writer, item, http.StatusAccepted)
+}
+
+func (s *Server) handleGetMyDeletion(writer http.ResponseWriter, request *http.Request) {
+	customerId, err := middleware.Authentication(request.Context())
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	item, err := s.customerSvc.DeletionRequest(request.Context(), customerId)
+	if err != nil {
+		writeCustomerError(writer, err)
+		return
+	}
+	parceJSON(writer, item)
+}
+
+func (s *Server) handleCancelMyDeletion(writer http.ResponseWriter, request *http.Request) {
+	customerId, err := middleware.Authentication(request.Context())
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	item, err := s.customerSvc.CancelDeletion(request.Context(), customerId)
+	if err != nil {
+		writeCustomerError(writer, err)
+		return
+	}
+	parceJSON(writer, item)
+}
@@ -0,0 +1,113 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/sidalsoft/crud/cmd/app/middleware"
+	"github.com/sidalsoft/crud/pkg/security"
+	"net/http"
+)
+
+//writeMFAError переводит ошибки второго фактора в HTTP-ответы
+func writeMFAError(writer http.ResponseWriter, err error) {
+	var locked *security.LockedError
+	var blocked *security.BlockedError
+	if errors.As(err, &locked) || errors.As(err, &blocked) {
+		writeLoginError(writer, err)
+		return
+	}
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, security.ErrInvalidCode), errors.Is(err, security.ErrNoSuchChallenge),
+		errors.Is(err, security.ErrTooManyCodeAttempts):
+		status = http.StatusUnauthorized
+	case errors.Is(err, security.ErrMFANotEnrolled), errors.Is(err, security.ErrMFAAlreadyEnrolled):
+		status = http.StatusConflict
+	case errors.Is(err, security.ErrMFARequired):
+		status = http.StatusForbidden
+	}
+	if status == http.StatusInternalServerError {
+		writeFail(writer, status, err)
+		return
+	}
+	parceErrJSON(writer, struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}{Status: "fail", Reason: err.Error()}, status)
+}
+
+func (s *Server) handleManagerGetMFA(writer http.ResponseWriter, request *http.Request) {
+	managerId, err := middleware.Authentication(request.Context())
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	enabled, err := s.mfaSvc.Enabled(request.Context(), managerId)
+	if err != nil {
+		writeMFAError(writer, err)
+		return
+	}
+	parceJSON(writer, struct {
+		Enabled bool `json:"enabled"`
+	}{Enabled: enabled})
+}
+
+//handleManagerEnrolTOTP выдаёт секрет и otpauth:// ссылку для QR-кода
+func (s *Server) handleManagerEnrolTOTP(writer http.ResponseWriter, request *http.Request) {
+	managerId, err := middleware.Authentication(request.Context())
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	enrolment, err := s.mfaSvc.BeginEnrolment(request.Context(), managerId)
+	if err != nil {
+		writeMFAError(writer, err)
+		return
+	}
+	parceJSON(writer, enrolment)
+}
+
+//handleManagerConfirmTOTP включает TOTP после первого верного кода и возвращает коды восстановления
+func (s *Server) handleManagerConfirmTOTP(writer http.ResponseWriter, request *http.Request) {
+	s.handleManagerCodeAction(writer, request, func(managerId int64, code string) ([]string, error) {
+		return s.mfaSvc.ConfirmEnrolment(request.Context(), managerId, code)
+	})
+}
+
+func (s *Server) handleManagerRecoveryCodes(writer http.ResponseWriter, request *http.Request) {
+	s.handleManagerCodeAction(writer, request, func(managerId int64, code string) ([]string, error) {
+		return s.mfaSvc.RegenerateRecoveryCodes(request.Context(), managerId, code)
+	})
+}
+
+func (s *Server) handleManagerDisableTOTP(writer http.ResponseWriter, request *http.Request) {
+	s.handleManagerCodeAction(writer, request, func(managerId int64, code string) ([]string, error) {
+		return nil, s.mfaSvc.Disable(request.Context(), managerId, code)
+	})
+}
+
+//handleManagerCodeAction разбирает {"code": "..."} и выполняет действие, подтверждённое TOTP-кодом
+func (s *Server) handleManagerCodeAction(writer http.ResponseWriter, request *http.Request, action func(managerId int64, code string) ([]string, error)) {
+	managerId, err := middleware.Authentication(request.Context())
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	data := struct {
+		Code string `json:"code"`
+	}{}
+	err = json.NewDecoder(request.Body).Decode(&data)
+	if err != nil || data.Code == "" {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	codes, err := action(managerId, data.Code)
+	if err != nil {
+		writeMFAError(writer, err)
+		return
+	}
+	parceJSON(writer, struct {
+		Status        string   `json:"status"`
+		RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+	}{Status: "ok", RecoveryCodes: codes})
+}
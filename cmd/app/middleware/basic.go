@@ -2,10 +2,12 @@ package middleware
 
 import (
 	"context"
-	"encoding/base64"
+	"crypto/x509"
 	"errors"
 	"github.com/sidalsoft/crud/pkg/security"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -13,67 +15,355 @@ var ErrNoAuthentication = errors.New("no authentication")
 
 type IDFunc func(ctx context.Context, token string) (int64, error)
 
-type HasAnyRoleFunc func(ctx context.Context, role string) bool
+//PrincipalFunc находит пользователя по токену
+type PrincipalFunc func(ctx context.Context, token string) (*Principal, error)
 
-func CheckRole(hasAnyRoleFunc HasAnyRoleFunc, role string) func(handler http.Handler) http.Handler {
+//PermissionsFunc возвращает права пользователя
+type PermissionsFunc func(ctx context.Context, principal *Principal) ([]string, error)
+
+//contextKey типизированный ключ контекста, чтобы не пересекаться со строковыми ключами других пакетов
+type contextKey struct {
+	name string
+}
+
+func (c *contextKey) String() string {
+	return "middleware context key " + c.name
+}
+
+var principalContextKey = &contextKey{"principal"}
+
+//Principal аутентифицированный пользователь запроса.
+//Kind заполняется, если он известен из токена или из маршрута
+type Principal struct {
+	ID   int64
+	Kind string
+	//APIKeyID и Scopes заполняются, если запрос пришёл с API-ключом: права ограничены Scopes
+	APIKeyID int64
+	Scopes   []string
+	//CertificateID заполняется, если пользователь определён по клиентскому сертификату mTLS
+	CertificateID int64
+
+	//permissions права, уже загруженные в этом запросе
+	permissions map[string]bool
+}
+
+//HasPermission проверяет право пользователя из контекста.
+//Права загружаются один раз за запрос и запоминаются в Principal
+func HasPermission(ctx context.Context, permissionsFunc PermissionsFunc, permission string) (bool, error) {
+	principal, err := PrincipalFrom(ctx)
+	if err != nil {
+		return false, err
+	}
+	if principal.permissions == nil {
+		permissions, err := permissionsFunc(ctx, principal)
+		if err != nil {
+			return false, err
+		}
+		principal.permissions = make(map[string]bool, len(permissions))
+		for _, item := range permissions {
+			principal.permissions[item] = true
+		}
+	}
+	return principal.permissions[permission], nil
+}
+
+//RequirePermission пропускает запрос, только если у пользователя есть все перечисленные права
+func RequirePermission(permissionsFunc PermissionsFunc, permissions ...string) func(handler http.Handler) http.Handler {
 	return func(handler http.Handler) http.Handler {
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-			if !hasAnyRoleFunc(request.Context(), role) {
-				http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
-				return
+			for _, permission := range permissions {
+				ok, err := HasPermission(request.Context(), permissionsFunc, permission)
+				if errors.Is(err, ErrNoAuthentication) {
+					unauthorized(writer, "")
+					return
+				}
+				if err != nil {
+					http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
+				}
+				if !ok {
+					http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+					return
+				}
 			}
 			handler.ServeHTTP(writer, request)
 		})
 	}
 }
 
-func Authentication(ctx context.Context) (int64, error) {
-	if value, ok := ctx.Value("idUser").(int64); ok {
+//WithPrincipal кладёт пользователя в контекст запроса и сообщает его Deprecated, если маршрут устаревший
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	if use, ok := ctx.Value(deprecatedContextKey).(*deprecatedUse); ok {
+		use.principal = principal
+	}
+	return context.WithValue(ctx, principalContextKey, principal)
+}
+
+//PrincipalFrom возвращает пользователя, положенного в контекст Authenticate
+func PrincipalFrom(ctx context.Context) (*Principal, error) {
+	if value, ok := ctx.Value(principalContextKey).(*Principal); ok && value != nil {
 		return value, nil
 	}
-	return 0, ErrNoAuthentication
+	return nil, ErrNoAuthentication
+}
+
+func Authentication(ctx context.Context) (int64, error) {
+	principal, err := PrincipalFrom(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return principal.ID, nil
+}
+
+//BearerToken достаёт токен из заголовка Authorization.
+//Поддерживается формат "Bearer <token>" и, для старых клиентов, токен без схемы
+func BearerToken(request *http.Request) (string, bool) {
+	authorization := strings.TrimSpace(request.Header.Get("Authorization"))
+	if authorization == "" {
+		return "", false
+	}
+	scheme, token, found := cut(authorization, " ")
+	if !found {
+		return authorization, true
+	}
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
 }
 
 func Authenticate(idFunc IDFunc) func(handler http.Handler) http.Handler {
+	return AuthenticatePrincipal(func(ctx context.Context, token string) (*Principal, error) {
+		id, err := idFunc(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		return &Principal{ID: id}, nil
+	})
+}
+
+//AuthenticatePrincipal пропускает запрос только с действующим Bearer-токеном
+//или с пользователем, уже положенным в контекст
+func AuthenticatePrincipal(principalFunc PrincipalFunc) func(handler http.Handler) http.Handler {
 	return func(handler http.Handler) http.Handler {
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-			token := request.Header.Get("Authorization")
+			//пользователь уже определён предыдущим middleware, например Basic
+			if _, err := PrincipalFrom(request.Context()); err == nil {
+				handler.ServeHTTP(writer, request)
+				return
+			}
+			token, ok := BearerToken(request)
+			if !ok {
+				unauthorized(writer, "")
+				return
+			}
 
-			id, err := idFunc(request.Context(), token)
+			principal, err := principalFunc(request.Context(), token)
+			if isTokenError(err) {
+				unauthorized(writer, err.Error())
+				return
+			}
 			if err != nil {
 				http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 				return
 			}
-			ctx := context.WithValue(request.Context(), "idUser", id)
+			ctx := WithPrincipal(request.Context(), principal)
 			request = request.WithContext(ctx)
 			handler.ServeHTTP(writer, request)
 		})
 	}
 }
 
-func Basic(authSvc *security.AuthService) func(http.Handler) http.Handler {
+//JWT проверяет подписанный токен без обращения к базе: ключ, алгоритм, подпись, издателя, срок
+//и список отозванных jti, который SessionService пополняет при выходе, отзыве сессий и блокировке.
+//Права по-прежнему берутся по текущим ролям из базы, а не по ролям из токена.
+//Через idFunc ищутся только непрозрачные токены
+func JWT(jwtSvc *security.JWTService, kind string, idFunc IDFunc) PrincipalFunc {
+	return func(ctx context.Context, token string) (*Principal, error) {
+		if !jwtSvc.Enabled() || !security.LooksLikeJWT(token) {
+			id, err := idFunc(ctx, token)
+			if err != nil {
+				return nil, err
+			}
+			return &Principal{ID: id, Kind: kind}, nil
+		}
+		claims, err := jwtSvc.Verify(token)
+		if err != nil {
+			return nil, err
+		}
+		subject, err := strconv.ParseInt(claims.Subject, 10, 64)
+		if err != nil || claims.Kind != kind {
+			return nil, security.ErrInvalidToken
+		}
+		return &Principal{ID: subject, Kind: claims.Kind}, nil
+	}
+}
+
+func isTokenError(err error) bool {
+	var blocked *security.BlockedError
+	return errors.As(err, &blocked) || errors.Is(err, security.ErrNoSuchUser) ||
+		errors.Is(err, security.ErrNoSuchToken) || errors.Is(err, security.ErrTokenExpired) ||
+		errors.Is(err, security.ErrTokenRevoked) || errors.Is(err, security.ErrInvalidToken)
+}
+
+//unauthorized отвечает 401 с заголовком WWW-Authenticate по RFC 6750
+func unauthorized(writer http.ResponseWriter, description string) {
+	challenge := `Bearer realm="api"`
+	if description != "" {
+		challenge += `, error="invalid_token", error_description="` + description + `"`
+	}
+	writer.Header().Set("WWW-Authenticate", challenge)
+	http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+func cut(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+//APIKeyHeader заголовок, в котором машинные клиенты передают API-ключ
+const APIKeyHeader = "X-API-Key"
+
+//APIKeyFunc находит пользователя по API-ключу
+type APIKeyFunc func(ctx context.Context, key string, client *security.Client) (*Principal, error)
+
+//APIKey аутентифицирует запросы с заголовком X-API-Key, остальные передаёт дальше без изменений
+func APIKey(keyFunc APIKeyFunc) func(http.Handler) http.Handler {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			key := strings.TrimSpace(request.Header.Get(APIKeyHeader))
+			if key == "" {
+				handler.ServeHTTP(writer, request)
+				return
+			}
+			principal, err := keyFunc(request.Context(), key, ClientFrom(request))
+			if isTokenError(err) {
+				http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			if errors.Is(err, security.ErrIPNotAllowed) {
+				http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			if err != nil {
+				http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			handler.ServeHTTP(writer, request.WithContext(WithPrincipal(request.Context(), principal)))
+		})
+	}
+}
+
+//Interactive не пускает запросы с API-ключом или клиентским сертификатом: управлять сессиями и вторым фактором может только сам человек
+func Interactive(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		principal, err := PrincipalFrom(request.Context())
+		if err == nil && (principal.APIKeyID != 0 || principal.CertificateID != 0) {
+			http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+//CertificateFunc находит пользователя по клиентскому сертификату, уже проверенному TLS
+type CertificateFunc func(ctx context.Context, certificate *x509.Certificate, client *security.Client) (*Principal, error)
+
+//ClientCertificate аутентифицирует запрос по клиентскому сертификату mTLS.
+//Токен, Basic или API-ключ в заголовках важнее сертификата терминала, поэтому с ними запрос
+//передаётся дальше без изменений, так же как и без сертификата или с сертификатом без привязки
+func ClientCertificate(certificateFunc CertificateFunc) func(http.Handler) http.Handler {
 	return func(handler http.Handler) http.Handler {
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-			authorization := request.Header.Get("Authorization")
+			if request.TLS == nil || len(request.TLS.VerifiedChains) == 0 ||
+				request.Header.Get("Authorization") != "" {
+				handler.ServeHTTP(writer, request)
+				return
+			}
+			if _, err := PrincipalFrom(request.Context()); err == nil {
+				handler.ServeHTTP(writer, request)
+				return
+			}
 
-			arr1 := strings.Split(string(authorization), " ")
-			if len(arr1) < 2 {
+			principal, err := certificateFunc(request.Context(), request.TLS.VerifiedChains[0][0], ClientFrom(request))
+			if errors.Is(err, security.ErrNoSuchToken) {
+				handler.ServeHTTP(writer, request)
+				return
+			}
+			if isTokenError(err) {
 				http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 				return
 			}
-			data, err := base64.StdEncoding.DecodeString(arr1[1])
-			if err != nil || len(data) == 0 {
-				http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			if errors.Is(err, security.ErrIPNotAllowed) {
+				http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			if err != nil {
+				http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 				return
 			}
-			arr := strings.Split(string(data), ":")
-			login := arr[0]
-			pass := arr[1]
-			if !authSvc.Auth(login, pass) {
+			handler.ServeHTTP(writer, request.WithContext(WithPrincipal(request.Context(), principal)))
+		})
+	}
+}
+
+//BasicFunc проверяет имя пользователя и пароль из HTTP Basic
+type BasicFunc func(ctx context.Context, username string, password string, client *security.Client) (*Principal, error)
+
+//ClientFrom IP и User-Agent клиента
+func ClientFrom(request *http.Request) *security.Client {
+	ip, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		ip = request.RemoteAddr
+	}
+	return &security.Client{IP: ip, UserAgent: request.UserAgent()}
+}
+
+//Basic аутентифицирует запросы со схемой Basic. Запросы с другой схемой передаются дальше без изменений,
+//поэтому Basic ставится перед AuthenticatePrincipal
+func Basic(realm string, basicFunc BasicFunc) func(http.Handler) http.Handler {
+	challenge := `Basic realm="` + strings.ReplaceAll(realm, `"`, `'`) + `", charset="UTF-8"`
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			scheme, _, _ := cut(strings.TrimSpace(request.Header.Get("Authorization")), " ")
+			if !strings.EqualFold(scheme, "Basic") {
+				handler.ServeHTTP(writer, request)
+				return
+			}
+
+			username, password, ok := request.BasicAuth()
+			if !ok || username == "" {
+				writer.Header().Set("WWW-Authenticate", challenge)
 				http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 				return
 			}
-			handler.ServeHTTP(writer, request)
+
+			principal, err := basicFunc(request.Context(), username, password, ClientFrom(request))
+			var locked *security.LockedError
+			if errors.As(err, &locked) {
+				writer.Header().Set("Retry-After", strconv.Itoa(int(locked.RetryAfter.Seconds())))
+				http.Error(writer, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			var blocked *security.BlockedError
+			if errors.As(err, &blocked) {
+				http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			if errors.Is(err, security.ErrNoSuchUser) || errors.Is(err, security.ErrInvalidPassword) ||
+				errors.Is(err, security.ErrBasicNotAllowed) {
+				writer.Header().Set("WWW-Authenticate", challenge)
+				http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			handler.ServeHTTP(writer, request.WithContext(WithPrincipal(request.Context(), principal)))
 		})
 	}
 }
@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+var deprecatedContextKey = &contextKey{"deprecated"}
+
+//deprecatedUse запоминает пользователя, которого аутентификация нашла уже после Deprecated
+type deprecatedUse struct {
+	principal *Principal
+}
+
+//Deprecated помечает устаревший маршрут заголовками Deprecation и Link и записывает в лог каждое обращение.
+//successorPrefix добавляется к пути запроса, чтобы получить адрес маршрута, который пришёл на замену.
+//Регистрируется до аутентификации, чтобы заголовки были и в ответе 401, а пользователь попадает в лог через WithPrincipal
+func Deprecated(successorPrefix string) func(handler http.Handler) http.Handler {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			successor := successorPrefix + request.URL.Path
+			use := &deprecatedUse{}
+			if principal, err := PrincipalFrom(request.Context()); err == nil {
+				use.principal = principal
+			}
+
+			writer.Header().Set("Deprecation", "true")
+			writer.Header().Add("Link", "<"+successor+`>; rel="successor-version"`)
+			handler.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), deprecatedContextKey, use)))
+
+			var id int64
+			kind := "anonymous"
+			if use.principal != nil {
+				id, kind = use.principal.ID, use.principal.Kind
+			}
+			log.Printf("deprecated route %s %s used by %s %d from %s, use %s",
+				request.Method, request.URL.Path, kind, id, request.RemoteAddr, successor)
+		})
+	}
+}
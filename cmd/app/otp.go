@@ -0,0 +1,182 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/sidalsoft/crud/cmd/app/middleware"
+	"github.com/sidalsoft/crud/pkg/customers"
+	"github.com/sidalsoft/crud/pkg/security"
+	"net/http"
+	"strconv"
+)
+
+//writeOTPError переводит ошибки одноразовых кодов в HTTP-ответы
+func writeOTPError(writer http.ResponseWriter, err error) {
+	if writePolicyError(writer, err) {
+		return
+	}
+	var cooldown *security.OTPCooldownError
+	if errors.As(err, &cooldown) {
+		writer.Header().Set("Retry-After", strconv.Itoa(int(cooldown.RetryAfter.Seconds())))
+		parceErrJSON(writer, struct {
+			Status string `json:"status"`
+			Reason string `json:"reason"`
+		}{Status: "fail", Reason: "code already sent"}, http.StatusTooManyRequests)
+		return
+	}
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, security.ErrInvalidCode), errors.Is(err, security.ErrTooManyCodeAttempts),
+		errors.Is(err, customers.ErrInvalidPhone):
+		status = http.StatusBadRequest
+	case errors.Is(err, customers.ErrPhoneTaken):
+		status = http.StatusConflict
+	}
+	if status == http.StatusInternalServerError {
+		writeFail(writer, status, err)
+		return
+	}
+	parceErrJSON(writer, struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}{Status: "fail", Reason: err.Error()}, status)
+}
+
+type phoneRequest struct {
+	Phone    string `json:"phone"`
+	Code     string `json:"code"`
+	Password string `json:"password"`
+}
+
+func decodePhoneRequest(writer http.ResponseWriter, request *http.Request, withCode bool) (*phoneRequest, bool) {
+	data := &phoneRequest{}
+	err := json.NewDecoder(request.Body).Decode(data)
+	if err != nil || data.Phone == "" || (withCode && data.Code == "") {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return nil, false
+	}
+	return data, true
+}
+
+//writeCodeSent отвечает одинаково, был ли номер зарегистрирован или нет
+func writeCodeSent(writer http.ResponseWriter) {
+	parceErrJSON(writer, struct {
+		Status string `json:"status"`
+	}{Status: "ok"}, http.StatusAccepted)
+}
+
+func writeOK(writer http.ResponseWriter) {
+	parceJSON(writer, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+//handlePasswordReset отправляет код сброса пароля покупателю или менеджеру
+func (s *Server) handlePasswordReset(kind string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		data, ok := decodePhoneRequest(writer, request, false)
+		if !ok {
+			return
+		}
+		var err error
+		if kind == security.KindManager {
+			err = s.managerSvc.StartPasswordReset(request.Context(), data.Phone)
+		} else {
+			err = s.customerSvc.StartPasswordReset(request.Context(), data.Phone)
+		}
+		if err != nil {
+			writeOTPError(writer, err)
+			return
+		}
+		writeCodeSent(writer)
+	}
+}
+
+//handlePasswordResetConfirm задаёт новый пароль по коду из SMS
+func (s *Server) handlePasswordResetConfirm(kind string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		data, ok := decodePhoneRequest(writer, request, true)
+		if !ok {
+			return
+		}
+		if data.Password == "" {
+			http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		var err error
+		if kind == security.KindManager {
+			err = s.managerSvc.ResetPassword(request.Context(), data.Phone, data.Code, data.Password)
+		} else {
+			err = s.customerSvc.ResetPassword(request.Context(), data.Phone, data.Code, data.Password)
+		}
+		s.auditLogin(request, security.AuditPasswordReset, kind, data.Phone, err)
+		if err != nil {
+			writeOTPError(writer, err)
+			return
+		}
+		writeOK(writer)
+	}
+}
+
+func (s *Server) handleResendPhoneVerification(writer http.ResponseWriter, request *http.Request) {
+	data, ok := decodePhoneRequest(writer, request, false)
+	if !ok {
+		return
+	}
+	err := s.customerSvc.SendPhoneVerification(request.Context(), data.Phone)
+	if err != nil {
+		writeOTPError(writer, err)
+		return
+	}
+	writeCodeSent(writer)
+}
+
+func (s *Server) handleVerifyPhone(writer http.ResponseWriter, request *http.Request) {
+	data, ok := decodePhoneRequest(writer, request, true)
+	if !ok {
+		return
+	}
+	err := s.customerSvc.VerifyPhone(request.Context(), data.Phone, data.Code)
+	if err != nil {
+		writeOTPError(writer, err)
+		return
+	}
+	writeOK(writer)
+}
+
+//handleChangeMyPhone отправляет код на новый номер покупателя
+func (s *Server) handleChangeMyPhone(writer http.ResponseWriter, request *http.Request) {
+	customerId, err := middleware.Authentication(request.Context())
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	data, ok := decodePhoneRequest(writer, request, false)
+	if !ok {
+		return
+	}
+	err = s.customerSvc.StartPhoneChange(request.Context(), customerId, data.Phone)
+	if err != nil {
+		writeOTPError(writer, err)
+		return
+	}
+	writeCodeSent(writer)
+}
+
+func (s *Server) handleConfirmMyPhone(writer http.ResponseWriter, request *http.Request) {
+	customerId, err := middleware.Authentication(request.Context())
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	data, ok := decodePhoneRequest(writer, request, true)
+	if !ok {
+		return
+	}
+	item, err := s.customerSvc.ConfirmPhoneChange(request.Context(), customerId, data.Phone, data.Code)
+	if err != nil {
+		writeOTPError(writer, err)
+		return
+	}
+	parceJSON(writer, newCustomerResponse(item))
+}
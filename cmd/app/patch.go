@@ -0,0 +1,183 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+//mergePatchType тип содержимого JSON Merge Patch (RFC 7396)
+const mergePatchType = "application/merge-patch+json"
+
+//maxPatchSize ограничивает размер тела PATCH
+const maxPatchSize = 1 << 20
+
+//errPatchMediaType тело PATCH должно быть JSON Merge Patch
+var errPatchMediaType = errors.New("unsupported media type, use " + mergePatchType)
+
+//errPatchTooLarge тело PATCH больше maxPatchSize
+var errPatchTooLarge = errors.New("patch too large")
+
+//patchError патч не применим к документу: неизвестное поле, null в обязательном поле или неверный тип
+type patchError struct {
+	Field  string
+	Reason string
+}
+
+func (e *patchError) Error() string {
+	if e.Field == "" {
+		return e.Reason
+	}
+	return e.Field + ": " + e.Reason
+}
+
+//readMergePatch читает тело PATCH. Кроме application/merge-patch+json принимается application/json.
+//writer нужен MaxBytesReader: при слишком большом теле сервер закроет соединение, а не будет дочитывать его
+func readMergePatch(writer http.ResponseWriter, request *http.Request) (map[string]interface{}, error) {
+	if value := request.Header.Get("Content-Type"); value != "" {
+		mediaType, _, err := mime.ParseMediaType(value)
+		if err != nil || (mediaType != mergePatchType && mediaType != "application/json") {
+			return nil, errPatchMediaType
+		}
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(writer, request.Body, maxPatchSize))
+	//MaxBytesReader отдаёт ровно maxPatchSize байт и ошибку, если тело длиннее
+	if err != nil && len(body) >= maxPatchSize {
+		return nil, errPatchTooLarge
+	}
+	if err != nil {
+		return nil, &patchError{Reason: "cannot read body"}
+	}
+	var patch map[string]interface{}
+	//патч, который не является объектом, по RFC 7396 заменил бы весь документ, а документ у нас всегда объект
+	if err := json.Unmarshal(body, &patch); err != nil || patch == nil {
+		return nil, &patchError{Reason: "patch must be a JSON object"}
+	}
+	return patch, nil
+}
+
+//mergePatch накладывает патч на doc по RFC 7396: поля патча заменяют поля документа, null удаляет поле,
+//вложенные объекты сливаются рекурсивно. null допустим только в полях из nullable.
+//doc - указатель на структуру с изменяемыми полями, результат слияния декодируется обратно в неё,
+//поэтому поле, которого нет в doc, - ошибка. Имена полей сравниваются с json-тегами doc точно:
+//encoding/json сопоставляет их без учёта регистра, и из "name" и "Name" в одном патче победил бы случайный
+func mergePatch(doc interface{}, patch map[string]interface{}, nullable ...string) error {
+	fields := jsonFields(reflect.TypeOf(doc).Elem())
+	for field, value := range patch {
+		if !contains(fields, field) {
+			return &patchError{Field: field, Reason: "unknown field"}
+		}
+		if value == nil && !contains(nullable, field) {
+			return &patchError{Field: field, Reason: "must not be null"}
+		}
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	var target map[string]interface{}
+	if err := json.Unmarshal(data, &target); err != nil {
+		return err
+	}
+	data, err = json.Marshal(mergeValue(target, patch))
+	if err != nil {
+		return err
+	}
+
+	//поля, удалённые патчем, должны стать нулевыми, а не сохранить прежние значения
+	value := reflect.ValueOf(doc).Elem()
+	value.Set(reflect.Zero(value.Type()))
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(doc); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return &patchError{Field: typeErr.Field, Reason: "must be " + typeErr.Type.String()}
+		}
+		return &patchError{Reason: err.Error()}
+	}
+	return nil
+}
+
+//jsonFields имена, под которыми encoding/json пишет поля структуры
+func jsonFields(docType reflect.Type) []string {
+	fields := make([]string, 0, docType.NumField())
+	for i := 0; i < docType.NumField(); i++ {
+		field := docType.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, name)
+	}
+	return fields
+}
+
+//mergeValue алгоритм MergePatch из RFC 7396
+func mergeValue(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+			continue
+		}
+		targetObject[name] = mergeValue(targetObject[name], value)
+	}
+	return targetObject
+}
+
+func contains(values []string, value string) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+//writePatchError отвечает 415 на неверный тип содержимого, 413 на слишком большое тело
+//и 400 на неприменимый патч. Возвращает false, если err не относится к разбору патча
+func writePatchError(writer http.ResponseWriter, err error) bool {
+	status := 0
+	switch {
+	case errors.Is(err, errPatchMediaType):
+		status = http.StatusUnsupportedMediaType
+	case errors.Is(err, errPatchTooLarge):
+		status = http.StatusRequestEntityTooLarge
+	}
+	if status != 0 {
+		parceErrJSON(writer, struct {
+			Status string `json:"status"`
+			Reason string `json:"reason"`
+		}{Status: "fail", Reason: err.Error()}, status)
+		return true
+	}
+	var patchErr *patchError
+	if !errors.As(err, &patchErr) {
+		return false
+	}
+	parceErrJSON(writer, struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}{Status: "fail", Reason: patchErr.Error()}, http.StatusBadRequest)
+	return true
+}
@@ -0,0 +1,170 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func decodeJSON(t *testing.T, data string) interface{} {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		t.Fatalf("%s: %v", data, err)
+	}
+	return value
+}
+
+//TestMergeValue примеры из приложения A RFC 7396
+func TestMergeValue(t *testing.T) {
+	tests := []struct {
+		target string
+		patch  string
+		want   string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		//имена членов сравниваются с учётом регистра
+		{`{"a":"b"}`, `{"A":"c"}`, `{"a":"b","A":"c"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.target+" + "+test.patch, func(t *testing.T) {
+			got := mergeValue(decodeJSON(t, test.target), decodeJSON(t, test.patch))
+			if want := decodeJSON(t, test.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("mergeValue() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+type patchDocument struct {
+	Name   string   `json:"name"`
+	Salary int      `json:"salary"`
+	BossId *int64   `json:"bossId"`
+	Roles  []string `json:"roles"`
+}
+
+func TestMergePatch(t *testing.T) {
+	boss := int64(3)
+	newBoss := int64(5)
+	tests := []struct {
+		name  string
+		patch string
+		want  *patchDocument
+		field string
+	}{
+		{
+			name:  "empty patch keeps document",
+			patch: `{}`,
+			want:  &patchDocument{Name: "Ann", Salary: 100, BossId: &boss, Roles: []string{"MANAGER"}},
+		},
+		{
+			name:  "changes only supplied fields",
+			patch: `{"salary":200,"bossId":5}`,
+			want:  &patchDocument{Name: "Ann", Salary: 200, BossId: &newBoss, Roles: []string{"MANAGER"}},
+		},
+		{
+			name:  "arrays are replaced",
+			patch: `{"roles":["ADMIN"]}`,
+			want:  &patchDocument{Name: "Ann", Salary: 100, BossId: &boss, Roles: []string{"ADMIN"}},
+		},
+		{
+			name:  "null clears nullable field",
+			patch: `{"bossId":null}`,
+			want:  &patchDocument{Name: "Ann", Salary: 100, Roles: []string{"MANAGER"}},
+		},
+		{name: "null in required field", patch: `{"name":null}`, field: "name"},
+		{name: "wrong type", patch: `{"salary":"high"}`, field: "salary"},
+		{name: "unknown field", patch: `{"password":"secret"}`, field: "password"},
+		{name: "field name in other case", patch: `{"Salary":200}`, field: "Salary"},
+		{name: "fields differing only by case", patch: `{"name":"Bob","Name":"Eve"}`, field: "Name"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			doc := &patchDocument{Name: "Ann", Salary: 100, BossId: &boss, Roles: []string{"MANAGER"}}
+			patch := decodeJSON(t, test.patch).(map[string]interface{})
+			err := mergePatch(doc, patch, "bossId")
+			if test.want != nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(doc, test.want) {
+					t.Errorf("doc = %+v, want %+v", doc, test.want)
+				}
+				return
+			}
+			var patchErr *patchError
+			if !errors.As(err, &patchErr) {
+				t.Fatalf("err = %v, want *patchError", err)
+			}
+			if patchErr.Field != test.field {
+				t.Errorf("field = %q, want %q", patchErr.Field, test.field)
+			}
+		})
+	}
+}
+
+func TestReadMergePatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+	}{
+		{name: "merge patch", contentType: mergePatchType, body: `{"name":"Ann"}`},
+		{name: "json", contentType: "application/json; charset=utf-8", body: `{"name":"Ann"}`},
+		{name: "no content type", body: `{"name":"Ann"}`},
+		{name: "json patch", contentType: "application/json-patch+json", body: `[]`, status: http.StatusUnsupportedMediaType},
+		{name: "not an object", contentType: mergePatchType, body: `["name"]`, status: http.StatusBadRequest},
+		{name: "null", contentType: mergePatchType, body: `null`, status: http.StatusBadRequest},
+		{name: "malformed", contentType: mergePatchType, body: `{"name":`, status: http.StatusBadRequest},
+		{
+			name:        "too large",
+			contentType: mergePatchType,
+			body:        `{"name":"` + strings.Repeat("a", maxPatchSize) + `"}`,
+			status:      http.StatusRequestEntityTooLarge,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPatch, "/", strings.NewReader(test.body))
+			if test.contentType != "" {
+				request.Header.Set("Content-Type", test.contentType)
+			}
+			recorder := httptest.NewRecorder()
+			patch, err := readMergePatch(recorder, request)
+			if test.status == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if patch["name"] != "Ann" {
+					t.Errorf("patch = %v", patch)
+				}
+				return
+			}
+			if !writePatchError(recorder, err) {
+				t.Fatalf("err = %v is not a patch error", err)
+			}
+			if recorder.Code != test.status {
+				t.Errorf("status = %d, want %d", recorder.Code, test.status)
+			}
+		})
+	}
+}
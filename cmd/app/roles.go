@@ -0,0 +1,111 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/sidalsoft/crud/pkg/security"
+	"net/http"
+	"strconv"
+)
+
+//writeRoleError переводит ошибки управления ролями в HTTP-ответы
+func writeRoleError(writer http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, security.ErrInvalidRole), errors.Is(err, security.ErrUnknownRole),
+		errors.Is(err, security.ErrUnknownPermission):
+		status = http.StatusBadRequest
+	case errors.Is(err, security.ErrNoSuchRole), errors.Is(err, security.ErrNoSuchUser):
+		status = http.StatusNotFound
+	case errors.Is(err, security.ErrProtectedRole):
+		status = http.StatusConflict
+	}
+	if status == http.StatusInternalServerError {
+		writeFail(writer, status, err)
+		return
+	}
+	parceErrJSON(writer, struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}{Status: "fail", Reason: err.Error()}, status)
+}
+
+func (s *Server) handleGetRoles(writer http.ResponseWriter, request *http.Request) {
+	items, err := s.rbacSvc.Roles(request.Context())
+	if err != nil {
+		writeRoleError(writer, err)
+		return
+	}
+	parceJSON(writer, items)
+}
+
+func (s *Server) handleGetPermissions(writer http.ResponseWriter, request *http.Request) {
+	items, err := s.rbacSvc.Permissions(request.Context())
+	if err != nil {
+		writeRoleError(writer, err)
+		return
+	}
+	parceJSON(writer, items)
+}
+
+//handleSaveRole создаёт роль или заменяет права существующей
+func (s *Server) handleSaveRole(writer http.ResponseWriter, request *http.Request) {
+	var role *security.Role
+	err := json.NewDecoder(request.Body).Decode(&role)
+	if err != nil || role == nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	item, err := s.rbacSvc.SaveRole(request.Context(), role)
+	s.audit(request, security.AuditRoleSave, security.AuditTargetRole, role.Name, err)
+	if err != nil {
+		writeRoleError(writer, err)
+		return
+	}
+	parceJSON(writer, item)
+}
+
+func (s *Server) handleDeleteRole(writer http.ResponseWriter, request *http.Request) {
+	name, ok := mux.Vars(request)["name"]
+	if !ok {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	err := s.rbacSvc.DeleteRole(request.Context(), name)
+	s.audit(request, security.AuditRoleDelete, security.AuditTargetRole, name, err)
+	if err != nil {
+		writeRoleError(writer, err)
+		return
+	}
+	parceJSON(writer, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+//handleSetManagerRoles заменяет роли менеджера
+func (s *Server) handleSetManagerRoles(writer http.ResponseWriter, request *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(request)["id"], 10, 64)
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	data := struct {
+		Roles []string `json:"roles"`
+	}{}
+	err = json.NewDecoder(request.Body).Decode(&data)
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	roles, err := s.rbacSvc.SetManagerRoles(request.Context(), id, data.Roles)
+	s.audit(request, security.AuditManagerRoles, security.KindManager, mux.Vars(request)["id"], err)
+	if err != nil {
+		writeRoleError(writer, err)
+		return
+	}
+	parceJSON(writer, struct {
+		ID    int64    `json:"id"`
+		Roles []string `json:"roles"`
+	}{ID: id, Roles: roles})
+}
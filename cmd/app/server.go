@@ -1,6 +1,7 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/gorilla/mux"
@@ -13,6 +14,7 @@ import (
 	"github.com/sidalsoft/crud/pkg/security"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"time"
 )
@@ -26,16 +28,36 @@ type Server struct {
 	salePositionsSvc *salePositions.SalePositionsService
 	saleSvc          *sales.SalesService
 	authSvc          *security.AuthService
+	sessionSvc       *security.SessionService
+	jwtSvc           *security.JWTService
+	throttle         *security.LoginThrottle
+	mfaSvc           *security.MFAService
+	rbacSvc          *security.RBACService
+	apiKeySvc        *security.APIKeyService
+	certificateSvc   *security.CertificateService
+	auditSvc         *security.AuditService
+	blockSvc         *security.BlockService
+	bootstrap        *security.BootstrapToken
 }
 
 func NewServer(mux *mux.Router, customerSvc *customers.Service,
 	authSvc *security.AuthService, managerSvc *managers.ManagersService,
 	productSvc *products.ProductService, salePositionsSvc *salePositions.SalePositionsService,
-	saleSvc *sales.SalesService) *Server {
+	saleSvc *sales.SalesService, sessionSvc *security.SessionService, jwtSvc *security.JWTService,
+	throttle *security.LoginThrottle, mfaSvc *security.MFAService, rbacSvc *security.RBACService,
+	apiKeySvc *security.APIKeyService, certificateSvc *security.CertificateService,
+	auditSvc *security.AuditService, blockSvc *security.BlockService) *Server {
 	return &Server{mux: mux, customerSvc: customerSvc,
 		authSvc: authSvc, managerSvc: managerSvc,
 		productSvc: productSvc, salePositionsSvc: salePositionsSvc,
-		saleSvc: saleSvc}
+		saleSvc: saleSvc, sessionSvc: sessionSvc, jwtSvc: jwtSvc,
+		throttle: throttle, mfaSvc: mfaSvc, rbacSvc: rbacSvc, apiKeySvc: apiKeySvc,
+		certificateSvc: certificateSvc, auditSvc: auditSvc, blockSvc: blockSvc}
+}
+
+//EnableBootstrap разрешает создать первого администратора по одноразовому токену
+func (s *Server) EnableBootstrap(token *security.BootstrapToken) {
+	s.bootstrap = token
 }
 
 func (s *Server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
@@ -45,45 +67,140 @@ func (s *Server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 const (
 	GET    = "GET"
 	POST   = "POST"
+	PUT    = "PUT"
+	PATCH  = "PATCH"
 	DELETE = "DELETE"
 )
 
 //INIt инициализирует сервер (регистрирует все Handlerы)
 func (s *Server) Init() {
+	s.mux.HandleFunc("/.well-known/jwks.json", s.handleJWKS).Methods(GET)
 
 	s.mux.HandleFunc("/api/customers", s.handleSave).Methods(POST)
 	s.mux.HandleFunc("/api/customers/token", s.handleGenerateToken).Methods(POST)
 	s.mux.HandleFunc("/api/customers/token/validate", s.handleValidateToken).Methods(POST)
-
+	s.mux.HandleFunc("/api/customers/token/refresh", s.handleRefreshToken(security.KindCustomer)).Methods(POST)
+	s.mux.HandleFunc("/api/customers/password/reset", s.handlePasswordReset(security.KindCustomer)).Methods(POST)
+	s.mux.HandleFunc("/api/customers/password/reset/confirm", s.handlePasswordResetConfirm(security.KindCustomer)).Methods(POST)
+	s.mux.HandleFunc("/api/customers/phone/verify", s.handleVerifyPhone).Methods(POST)
+	s.mux.HandleFunc("/api/customers/phone/verify/resend", s.handleResendPhoneVerification).Methods(POST)
+	customerAuth := middleware.AuthenticatePrincipal(middleware.JWT(s.jwtSvc, security.KindCustomer, s.customerSvc.IDByToken))
+	s.mux.Handle("/api/customers/logout", customerAuth(s.handleLogout(security.KindCustomer))).Methods(POST)
+	s.mux.Handle("/api/customers/sessions", customerAuth(s.handleGetSessions(security.KindCustomer))).Methods(GET)
+	s.mux.Handle("/api/customers/sessions", customerAuth(s.handleRevokeSessions(security.KindCustomer))).Methods(DELETE)
+	s.mux.Handle("/api/customers/sessions/{id}", customerAuth(s.handleRevokeSession(security.KindCustomer))).Methods(DELETE)
+
+	meSubrouter := s.mux.PathPrefix("/api/customers/me").Subrouter()
+	meSubrouter.Use(customerAuth)
+	meSubrouter.HandleFunc("", s.handleGetMe).Methods(GET)
+	meSubrouter.HandleFunc("", s.handleUpdateMe).Methods(PUT)
+	meSubrouter.HandleFunc("/password", s.handleChangeMyPassword).Methods(POST)
+	meSubrouter.HandleFunc("/phone", s.handleChangeMyPhone).Methods(POST)
+	meSubrouter.HandleFunc("/phone/confirm", s.handleConfirmMyPhone).Methods(POST)
+	meSubrouter.HandleFunc("/purchases", s.handleGetMyPurchases).Methods(GET)
+	meSubrouter.HandleFunc("/deletion-request", s.handleRequestMyDeletion).Methods(POST)
+	meSubrouter.HandleFunc("/deletion-request", s.handleGetMyDeletion).Methods(GET)
+	meSubrouter.HandleFunc("/deletion-request", s.handleCancelMyDeletion).Methods(DELETE)
+
+	s.mux.HandleFunc("/api/managers/token", s.handleManagerGetToken).Methods(POST)
+	s.mux.HandleFunc("/api/managers/bootstrap", s.handleManagerBootstrap).Methods(POST)
+	s.mux.HandleFunc("/api/managers/token/refresh", s.handleRefreshToken(security.KindManager)).Methods(POST)
+	s.mux.HandleFunc("/api/managers/password/reset", s.handlePasswordReset(security.KindManager)).Methods(POST)
+	s.mux.HandleFunc("/api/managers/password/reset/confirm", s.handlePasswordResetConfirm(security.KindManager)).Methods(POST)
+
+	managerAuth := middleware.AuthenticatePrincipal(middleware.JWT(s.jwtSvc, security.KindManager, s.managerSvc.IDByToken))
+	if s.authSvc.BasicEnabled() {
+		//машинные клиенты могут вместо токена передавать телефон и пароль менеджера в HTTP Basic
+		bearerAuth := managerAuth
+		basicAuth := middleware.Basic(s.authSvc.BasicRealm(), s.basicManager)
+		managerAuth = func(handler http.Handler) http.Handler {
+			return basicAuth(bearerAuth(handler))
+		}
+	}
+	//терминалы филиалов в режиме mTLS аутентифицируются клиентским сертификатом
+	//API-ключ в X-API-Key принимается наравне с токеном менеджера
+	tokenAuth := managerAuth
+	apiKeyAuth := middleware.APIKey(s.apiKeyManager)
+	certificateAuth := middleware.ClientCertificate(s.certificateManager)
+	managerAuth = func(handler http.Handler) http.Handler {
+		return apiKeyAuth(certificateAuth(tokenAuth(handler)))
+	}
 	managersSubrouter := s.mux.PathPrefix("/api/managers").Subrouter()
-	managersSubrouter.Use(middleware.Authenticate(s.managerSvc.IDByToken))
-	managersSubrouter.HandleFunc("/token", s.handleManagerGetToken).Methods(POST)
-	managersSubrouter.HandleFunc("/sales", s.handleManagerGetSales).Methods(GET)
-	managersSubrouter.HandleFunc("/sales", s.handleManagerMakeSale).Methods(POST)
-	managersSubrouter.HandleFunc("/products", s.handleManagerGetProducts).Methods(GET)
-	managersSubrouter.HandleFunc("/products/{id}", s.handleManagerRemoveProductByID).Methods(DELETE)
-	managersSubrouter.HandleFunc("/customers", s.handleManagerGetCustomers).Methods(GET)
-	managersSubrouter.HandleFunc("/customers", s.handleManagerChangeCustomer).Methods(POST)
-	managersSubrouter.HandleFunc("/customers/{id}", s.handleManagerRemoveCustomerByID).Methods(DELETE)
-	isAdmin := middleware.CheckRole(s.managerSvc.HasAnyRole, "ADMIN")
-	managersSubrouter.HandleFunc("", isAdmin(http.HandlerFunc(s.handleManagerRegistration)).ServeHTTP).Methods(POST)
-	managersSubrouter.HandleFunc("/products", s.handleManagerChangeProduct).Methods(POST)
-
-	//s.mux.Use(middleware.Basic(s.authSvc))
-	//s.mux.HandleFunc("/customers.getAll", s.handleGetAllCustomers)
-	s.mux.HandleFunc("/customers", s.handleGetAllCustomers).Methods(GET)
-	//s.mux.HandleFunc("/customers.getById", s.handleGetCustomerByID)
-	s.mux.HandleFunc("/customers/active", s.handleGetAllActiveCustomers).Methods(GET)
-	s.mux.HandleFunc("/customers/{id}", s.handleGetCustomerByID).Methods(GET)
-	//s.mux.HandleFunc("/customers", s.handleGetAllActiveCustomers)
-	//s.mux.HandleFunc("/customers.blockById", s.handleBlockByID)
-	s.mux.HandleFunc("/customers/{id}/block", s.handleBlockByID).Methods(POST)
-	//s.mux.HandleFunc("/customers.unblockById", s.handleUnBlockByID)
-	s.mux.HandleFunc("/customers/{id}/block", s.handleUnBlockByID).Methods(DELETE)
-	//s.mux.HandleFunc("/customers.removeById", s.handleDelete)
-	s.mux.HandleFunc("/customers/{id}", s.handleDelete).Methods(DELETE)
-	//s.mux.HandleFunc("/customers.save", s.handleSave)
-	s.mux.HandleFunc("/customers", s.handleSave).Methods(POST)
+	managersSubrouter.Use(managerAuth)
+	interactive := middleware.Interactive
+	managersSubrouter.Handle("/logout", interactive(s.handleLogout(security.KindManager))).Methods(POST)
+	managersSubrouter.Handle("/sessions", interactive(s.handleGetSessions(security.KindManager))).Methods(GET)
+	managersSubrouter.Handle("/sessions", interactive(s.handleRevokeSessions(security.KindManager))).Methods(DELETE)
+	managersSubrouter.Handle("/sessions/{id}", interactive(s.handleRevokeSession(security.KindManager))).Methods(DELETE)
+	managersSubrouter.Handle("/mfa", interactive(http.HandlerFunc(s.handleManagerGetMFA))).Methods(GET)
+	managersSubrouter.Handle("/mfa/totp", interactive(http.HandlerFunc(s.handleManagerEnrolTOTP))).Methods(POST)
+	managersSubrouter.Handle("/mfa/totp", interactive(http.HandlerFunc(s.handleManagerDisableTOTP))).Methods(DELETE)
+	managersSubrouter.Handle("/mfa/totp/confirm", interactive(http.HandlerFunc(s.handleManagerConfirmTOTP))).Methods(POST)
+	managersSubrouter.Handle("/mfa/recovery-codes", interactive(http.HandlerFunc(s.handleManagerRecoveryCodes))).Methods(POST)
+	can := func(permissions ...string) func(http.Handler) http.Handler {
+		return middleware.RequirePermission(s.managerSvc.Permissions, permissions...)
+	}
+	managersSubrouter.Handle("/sales", can(security.PermSalesRead)(http.HandlerFunc(s.handleManagerGetSales))).Methods(GET)
+	managersSubrouter.Handle("/sales", can(security.PermSalesWrite)(http.HandlerFunc(s.handleManagerMakeSale))).Methods(POST)
+	managersSubrouter.Handle("/products", can(security.PermProductsRead)(http.HandlerFunc(s.handleManagerGetProducts))).Methods(GET)
+	managersSubrouter.Handle("/products", can(security.PermProductsWrite)(http.HandlerFunc(s.handleManagerChangeProduct))).Methods(POST)
+	managersSubrouter.Handle("/products/{id}", can(security.PermProductsWrite)(http.HandlerFunc(s.handleManagerPatchProduct))).Methods(PATCH)
+	managersSubrouter.Handle("/products/{id}", can(security.PermProductsDelete)(http.HandlerFunc(s.handleManagerRemoveProductByID))).Methods(DELETE)
+	managersSubrouter.Handle("/products/{id}/restore", can(security.PermProductsWrite)(http.HandlerFunc(s.handleManagerRestoreProduct))).Methods(POST)
+	managersSubrouter.Handle("/customers", can(security.PermCustomersRead)(http.HandlerFunc(s.handleManagerGetCustomers))).Methods(GET)
+	managersSubrouter.Handle("/customers", can(security.PermCustomersWrite)(http.HandlerFunc(s.handleManagerChangeCustomer))).Methods(POST)
+	managersSubrouter.Handle("/customers/{id}", can(security.PermCustomersWrite)(http.HandlerFunc(s.handleManagerPatchCustomer))).Methods(PATCH)
+	managersSubrouter.Handle("/customers/{id}", can(security.PermCustomersDelete)(http.HandlerFunc(s.handleManagerRemoveCustomerByID))).Methods(DELETE)
+	managersSubrouter.Handle("/customers/active", can(security.PermCustomersRead)(http.HandlerFunc(s.handleGetAllActiveCustomers))).Methods(GET)
+	managersSubrouter.Handle("/customers/{id}", can(security.PermCustomersRead)(http.HandlerFunc(s.handleGetCustomerByID))).Methods(GET)
+	managersSubrouter.Handle("/customers/{id}/block", can(security.PermCustomersWrite)(s.handleBlock(security.KindCustomer))).Methods(POST)
+	managersSubrouter.Handle("/customers/{id}/block", can(security.PermCustomersWrite)(s.handleUnblock(security.KindCustomer))).Methods(DELETE)
+	managersSubrouter.Handle("", can(security.PermManagersWrite)(http.HandlerFunc(s.handleManagerRegistration))).Methods(POST)
+	managersSubrouter.Handle("/managers", can(security.PermManagersRead)(http.HandlerFunc(s.handleGetManagers))).Methods(GET)
+	managersSubrouter.Handle("/managers/{id}", can(security.PermManagersRead)(http.HandlerFunc(s.handleGetManagerByID))).Methods(GET)
+	managersSubrouter.Handle("/managers/{id}", can(security.PermManagersWrite)(http.HandlerFunc(s.handleUpdateManager))).Methods(PUT)
+	managersSubrouter.Handle("/managers/{id}", can(security.PermManagersWrite)(http.HandlerFunc(s.handleManagerPatchManager))).Methods(PATCH)
+	managersSubrouter.Handle("/managers/{id}/active", can(security.PermManagersWrite)(http.HandlerFunc(s.handleChangeManagerActive))).Methods(PUT)
+	managersSubrouter.Handle("/managers/{id}/block", can(security.PermManagersWrite)(s.handleBlock(security.KindManager))).Methods(POST)
+	managersSubrouter.Handle("/managers/{id}/block", can(security.PermManagersWrite)(s.handleUnblock(security.KindManager))).Methods(DELETE)
+	managersSubrouter.Handle("/managers/{id}/roles", can(security.PermRolesWrite)(http.HandlerFunc(s.handleSetManagerRoles))).Methods(PUT)
+	managersSubrouter.Handle("/managers/{id}/sessions", can(security.PermSessionsRevoke)(s.handleRevokeUserSessions(security.KindManager))).Methods(DELETE)
+	managersSubrouter.Handle("/customers/{id}/sessions", can(security.PermSessionsRevoke)(s.handleRevokeUserSessions(security.KindCustomer))).Methods(DELETE)
+	managersSubrouter.Handle("/lockouts", can(security.PermLockoutsRead)(http.HandlerFunc(s.handleGetLockouts))).Methods(GET)
+	managersSubrouter.Handle("/roles", can(security.PermRolesRead)(http.HandlerFunc(s.handleGetRoles))).Methods(GET)
+	managersSubrouter.Handle("/roles", can(security.PermRolesWrite)(http.HandlerFunc(s.handleSaveRole))).Methods(POST)
+	managersSubrouter.Handle("/roles/{name}", can(security.PermRolesWrite)(http.HandlerFunc(s.handleDeleteRole))).Methods(DELETE)
+	managersSubrouter.Handle("/permissions", can(security.PermRolesRead)(http.HandlerFunc(s.handleGetPermissions))).Methods(GET)
+	managersSubrouter.Handle("/api-keys", can(security.PermAPIKeysRead)(http.HandlerFunc(s.handleGetAPIKeys))).Methods(GET)
+	managersSubrouter.Handle("/api-keys", can(security.PermAPIKeysWrite)(interactive(http.HandlerFunc(s.handleCreateAPIKey)))).Methods(POST)
+	managersSubrouter.Handle("/api-keys/{id}", can(security.PermAPIKeysWrite)(http.HandlerFunc(s.handleRevokeAPIKey))).Methods(DELETE)
+	managersSubrouter.Handle("/client-certificates", can(security.PermAPIKeysRead)(http.HandlerFunc(s.handleGetClientCertificates))).Methods(GET)
+	managersSubrouter.Handle("/client-certificates", can(security.PermAPIKeysWrite)(interactive(http.HandlerFunc(s.handleBindClientCertificate)))).Methods(POST)
+	managersSubrouter.Handle("/client-certificates/{id}", can(security.PermAPIKeysWrite)(http.HandlerFunc(s.handleRevokeClientCertificate))).Methods(DELETE)
+	managersSubrouter.Handle("/audit", can(security.PermAuditRead)(http.HandlerFunc(s.handleGetAuditEvents))).Methods(GET)
+	managersSubrouter.Handle("/audit/verify", can(security.PermAuditRead)(http.HandlerFunc(s.handleVerifyAuditEvents))).Methods(GET)
+
+	//старые маршруты /customers оставлены для совместимости, доступны только менеджерам
+	//и будут удалены, замена - /api/managers/customers
+	legacySubrouter := s.mux.PathPrefix("/customers").Subrouter()
+	//Deprecated идёт первым, чтобы заголовки о выводе из употребления были и в ответе 401
+	legacySubrouter.Use(middleware.Deprecated("/api/managers"), managerAuth)
+	legacySubrouter.Handle("", can(security.PermCustomersRead)(http.HandlerFunc(s.handleGetAllCustomers))).Methods(GET)
+	legacySubrouter.Handle("", can(security.PermCustomersWrite)(http.HandlerFunc(s.handleSave))).Methods(POST)
+	legacySubrouter.Handle("/active", can(security.PermCustomersRead)(http.HandlerFunc(s.handleGetAllActiveCustomers))).Methods(GET)
+	legacySubrouter.Handle("/{id}", can(security.PermCustomersRead)(http.HandlerFunc(s.handleGetCustomerByID))).Methods(GET)
+	legacySubrouter.Handle("/{id}", can(security.PermCustomersDelete)(http.HandlerFunc(s.handleManagerRemoveCustomerByID))).Methods(DELETE)
+	legacySubrouter.Handle("/{id}/block", can(security.PermCustomersWrite)(s.handleBlock(security.KindCustomer))).Methods(POST)
+	legacySubrouter.Handle("/{id}/block", can(security.PermCustomersWrite)(s.handleUnblock(security.KindCustomer))).Methods(DELETE)
+}
+
+//basicManager проверяет учётные данные менеджера из HTTP Basic
+func (s *Server) basicManager(ctx context.Context, phone string, pass string, client *security.Client) (*middleware.Principal, error) {
+	id, err := s.authSvc.Auth(ctx, phone, pass, client)
+	if err != nil {
+		return nil, err
+	}
+	return &middleware.Principal{ID: id, Kind: security.KindManager}, nil
 }
 
 func (s *Server) handleGetCustomerByID(writer http.ResponseWriter, request *http.Request) {
@@ -94,7 +211,8 @@ func (s *Server) handleGetCustomerByID(writer http.ResponseWriter, request *http
 	}
 	id, err := strconv.ParseInt(idParam, 10, 64)
 	if err != nil {
-		log.Print(err)
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
 	}
 
 	item, err := s.customerSvc.ByID(request.Context(), id)
@@ -103,11 +221,11 @@ func (s *Server) handleGetCustomerByID(writer http.ResponseWriter, request *http
 		return
 	}
 	if err != nil {
-		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeFail(writer, http.StatusInternalServerError, err)
 		return
 	}
 
-	data, err := json.Marshal(item)
+	data, err := json.Marshal(newCustomerResponse(item))
 	if err != nil {
 		log.Print(err)
 	}
@@ -121,119 +239,44 @@ func (s *Server) handleGetCustomerByID(writer http.ResponseWriter, request *http
 func (s *Server) handleGetAllCustomers(writer http.ResponseWriter, request *http.Request) {
 	items, err := s.customerSvc.All(request.Context())
 	if err != nil {
-		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeFail(writer, http.StatusInternalServerError, err)
 		return
 	}
-	parceJSON(writer, items)
+	parceJSON(writer, newCustomerResponses(items))
 }
 
 func (s *Server) handleGetAllActiveCustomers(writer http.ResponseWriter, request *http.Request) {
 
 	items, err := s.customerSvc.AllActive(request.Context())
 	if err != nil {
-		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
-	}
-
-	parceJSON(writer, items)
-}
-
-func (s *Server) handleBlockByID(writer http.ResponseWriter, request *http.Request) {
-	idParam, ok := mux.Vars(request)["id"]
-	if !ok {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
-	}
-
-	id, err := strconv.ParseInt(idParam, 10, 64)
-	if err != nil {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
-	}
-
-	item, err := s.customerSvc.ChangeActive(request.Context(), id, false)
-
-	if errors.Is(err, customers.ErrNotFound) {
-		if err != nil {
-			http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			return
-		}
-	}
-
-	if err != nil {
-		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
-	}
-	parceJSON(writer, item)
-}
-
-func (s *Server) handleUnBlockByID(writer http.ResponseWriter, request *http.Request) {
-	idParam, ok := mux.Vars(request)["id"]
-	if !ok {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
-	}
-	id, err := strconv.ParseInt(idParam, 10, 64)
-	if err != nil {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		writeFail(writer, http.StatusInternalServerError, err)
 		return
 	}
 
-	item, err := s.customerSvc.ChangeActive(request.Context(), id, true)
-
-	if errors.Is(err, customers.ErrNotFound) {
-		http.Error(writer, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-		return
-	}
-
-	if err != nil {
-		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
-	}
-	parceJSON(writer, item)
+	parceJSON(writer, newCustomerResponses(items))
 }
 
-func (s *Server) handleDelete(writer http.ResponseWriter, request *http.Request) {
-	idParam, ok := mux.Vars(request)["id"]
-	if !ok {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
-	}
-	id, err := strconv.ParseInt(idParam, 10, 64)
+func (s *Server) handleSave(writer http.ResponseWriter, request *http.Request) {
+	data := &customerRequest{}
+	err := json.NewDecoder(request.Body).Decode(data)
 	if err != nil {
 		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
-
-	item, err := s.customerSvc.Delete(request.Context(), id)
-
-	if errors.Is(err, customers.ErrNotFound) {
-		http.Error(writer, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-		return
-	}
-
-	if err != nil {
-		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	customer, err := s.customerSvc.Save(request.Context(), data.model())
+	if writePolicyError(writer, err) {
 		return
 	}
-	parceJSON(writer, item)
-}
-
-func (s *Server) handleSave(writer http.ResponseWriter, request *http.Request) {
-	var item *customers.Customer
-	err := json.NewDecoder(request.Body).Decode(&item)
 	if err != nil {
-		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		writeFail(writer, http.StatusInternalServerError, err)
 		return
 	}
-	item.Active = true
-	item.Created = time.Now()
-	customer, err := s.customerSvc.Save(request.Context(), item)
+	//войти можно только после подтверждения номера кодом из SMS
+	err = s.customerSvc.SendPhoneVerification(request.Context(), customer.Phone)
 	if err != nil {
-		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+		log.Println(err)
 	}
-	parceJSON(writer, customer)
+	parceJSON(writer, newCustomerResponse(customer))
 }
 
 func (s *Server) handleGenerateToken(writer http.ResponseWriter, request *http.Request) {
@@ -246,14 +289,13 @@ func (s *Server) handleGenerateToken(writer http.ResponseWriter, request *http.R
 		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
-	token, err := s.authSvc.TokenForCustomer(request.Context(), data.Login, data.Password)
+	token, err := s.authSvc.TokenForCustomer(request.Context(), data.Login, data.Password, clientFrom(request))
+	s.auditLogin(request, security.AuditLogin, security.KindCustomer, data.Login, err)
 	if err != nil {
-		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeLoginError(writer, err)
 		return
 	}
-	parceJSON(writer, struct {
-		Token string `json:"token"`
-	}{Token: token})
+	parceJSON(writer, token)
 }
 
 func (s *Server) handleValidateToken(writer http.ResponseWriter, request *http.Request) {
@@ -276,7 +318,7 @@ func (s *Server) handleValidateToken(writer http.ResponseWriter, request *http.R
 		return
 	}
 	if err != nil {
-		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeFail(writer, http.StatusInternalServerError, err)
 		return
 	}
 	if expire.Unix() < time.Now().Unix() {
@@ -293,6 +335,11 @@ func (s *Server) handleValidateToken(writer http.ResponseWriter, request *http.R
 	}{Status: "ok", CustomerId: id})
 }
 
+func (s *Server) handleJWKS(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Cache-Control", "public, max-age=300")
+	parceJSON(writer, s.jwtSvc.JWKS())
+}
+
 func parceJSON(writer http.ResponseWriter, iData interface{}) {
 
 	data, err := json.Marshal(iData)
@@ -324,3 +371,26 @@ func parceErrJSON(writer http.ResponseWriter, iData interface{}, code int) {
 		log.Print(err)
 	}
 }
+
+//writeFail отвечает статусом без подробностей и пишет причину в лог
+func writeFail(writer http.ResponseWriter, status int, err error) {
+	log.Println(http.StatusText(status), err)
+	http.Error(writer, http.StatusText(status), status)
+}
+
+//pageParams разбирает limit и offset из запроса. Отсутствующее значение - 0,
+//нечисловое или отрицательное - ошибка
+func pageParams(query url.Values) (limit int, offset int, err error) {
+	values := [2]int{}
+	for i, name := range []string{"limit", "offset"} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		values[i], err = strconv.Atoi(value)
+		if err != nil || values[i] < 0 {
+			return 0, 0, errors.New("invalid " + name)
+		}
+	}
+	return values[0], values[1], nil
+}
@@ -0,0 +1,224 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/sidalsoft/crud/cmd/app/middleware"
+	"github.com/sidalsoft/crud/pkg/security"
+	"github.com/sidalsoft/crud/pkg/security/password"
+	"net/http"
+	"strconv"
+)
+
+//clientFrom собирает сведения об устройстве для сохранения в сессии
+func clientFrom(request *http.Request) *security.Client {
+	return middleware.ClientFrom(request)
+}
+
+//writeLoginError отвечает одинаково на неизвестный номер и неверный пароль,
+//чтобы по ответу нельзя было узнать, зарегистрирован ли телефон
+func writeLoginError(writer http.ResponseWriter, err error) {
+	var locked *security.LockedError
+	if errors.As(err, &locked) {
+		writer.Header().Set("Retry-After", strconv.Itoa(int(locked.RetryAfter.Seconds())))
+		parceErrJSON(writer, struct {
+			Status string `json:"status"`
+			Reason string `json:"reason"`
+		}{Status: "fail", Reason: "too many attempts"}, http.StatusTooManyRequests)
+		return
+	}
+	var blocked *security.BlockedError
+	if errors.As(err, &blocked) {
+		writeBlockedError(writer, blocked)
+		return
+	}
+	if errors.Is(err, security.ErrNoSuchUser) || errors.Is(err, security.ErrInvalidPassword) {
+		parceErrJSON(writer, struct {
+			Status string `json:"status"`
+			Reason string `json:"reason"`
+		}{Status: "fail", Reason: "invalid credentials"}, http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, security.ErrPhoneNotVerified) {
+		parceErrJSON(writer, struct {
+			Status string `json:"status"`
+			Reason string `json:"reason"`
+		}{Status: "fail", Reason: "phone not verified"}, http.StatusForbidden)
+		return
+	}
+	writeFail(writer, http.StatusInternalServerError, err)
+}
+
+//writePolicyError отвечает 400 с причиной, если пароль не прошёл политику
+func writePolicyError(writer http.ResponseWriter, err error) bool {
+	var policyErr *password.PolicyError
+	if !errors.As(err, &policyErr) {
+		return false
+	}
+	parceErrJSON(writer, struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}{Status: "fail", Reason: policyErr.Reason}, http.StatusBadRequest)
+	return true
+}
+
+//handleGetLockouts возвращает блокировки входа, ?kind=&value=&active=true&limit=&offset=
+func (s *Server) handleGetLockouts(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	filter := &security.LockoutFilter{
+		Kind:   query.Get("kind"),
+		Value:  query.Get("value"),
+		Active: query.Get("active") == "true",
+	}
+	var err error
+	filter.Limit, filter.Offset, err = pageParams(query)
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	items, err := s.throttle.Lockouts(request.Context(), filter)
+	if err != nil {
+		writeFail(writer, http.StatusInternalServerError, err)
+		return
+	}
+	parceJSON(writer, items)
+}
+
+//handleRefreshToken обменивает refresh-токен на новую пару токенов
+func (s *Server) handleRefreshToken(kind string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		data := struct {
+			RefreshToken string `json:"refreshToken"`
+		}{}
+		err := json.NewDecoder(request.Body).Decode(&data)
+		if err != nil || data.RefreshToken == "" {
+			http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		token, err := s.sessionSvc.Refresh(request.Context(), kind, data.RefreshToken, clientFrom(request))
+		s.auditLogin(request, security.AuditTokenRefresh, kind, "", err)
+		if errors.Is(err, security.ErrNoSuchToken) || errors.Is(err, security.ErrTokenExpired) ||
+			errors.Is(err, security.ErrTokenRevoked) || errors.Is(err, security.ErrTokenReused) ||
+			errors.Is(err, security.ErrNoSuchUser) {
+			parceErrJSON(writer, struct {
+				Status string `json:"status"`
+				Reason string `json:"reason"`
+			}{Status: "fail", Reason: err.Error()}, http.StatusUnauthorized)
+			return
+		}
+		var blocked *security.BlockedError
+		if errors.As(err, &blocked) {
+			writeBlockedError(writer, blocked)
+			return
+		}
+		if err != nil {
+			writeFail(writer, http.StatusInternalServerError, err)
+			return
+		}
+		parceJSON(writer, token)
+	}
+}
+
+//handleLogout отзывает токен, с которым пришёл запрос
+func (s *Server) handleLogout(kind string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		token, ok := middleware.BearerToken(request)
+		if !ok {
+			http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		err := s.sessionSvc.RevokeToken(request.Context(), kind, token)
+		if err != nil && !errors.Is(err, security.ErrNoSuchSession) {
+			writeFail(writer, http.StatusInternalServerError, err)
+			return
+		}
+		parceJSON(writer, struct {
+			Status string `json:"status"`
+		}{Status: "ok"})
+	}
+}
+
+//handleGetSessions возвращает действующие сессии текущего пользователя
+func (s *Server) handleGetSessions(kind string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		id, err := middleware.Authentication(request.Context())
+		if err != nil {
+			http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		items, err := s.sessionSvc.List(request.Context(), kind, id)
+		if err != nil {
+			writeFail(writer, http.StatusInternalServerError, err)
+			return
+		}
+		parceJSON(writer, items)
+	}
+}
+
+//handleRevokeSession отзывает одну из сессий текущего пользователя
+func (s *Server) handleRevokeSession(kind string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		id, err := middleware.Authentication(request.Context())
+		if err != nil {
+			http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		sessionID, err := strconv.ParseInt(mux.Vars(request)["id"], 10, 64)
+		if err != nil {
+			http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		err = s.sessionSvc.Revoke(request.Context(), kind, id, sessionID)
+		if errors.Is(err, security.ErrNoSuchSession) {
+			http.Error(writer, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeFail(writer, http.StatusInternalServerError, err)
+			return
+		}
+		parceJSON(writer, struct {
+			Status string `json:"status"`
+		}{Status: "ok"})
+	}
+}
+
+//handleRevokeSessions отзывает все сессии текущего пользователя, включая текущую
+func (s *Server) handleRevokeSessions(kind string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		id, err := middleware.Authentication(request.Context())
+		if err != nil {
+			http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		revoked, err := s.sessionSvc.RevokeAll(request.Context(), kind, id)
+		if err != nil {
+			writeFail(writer, http.StatusInternalServerError, err)
+			return
+		}
+		parceJSON(writer, struct {
+			Revoked int64 `json:"revoked"`
+		}{Revoked: revoked})
+	}
+}
+
+//handleRevokeUserSessions отзывает все сессии указанного менеджера или покупателя (для администратора)
+func (s *Server) handleRevokeUserSessions(kind string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		id, err := strconv.ParseInt(mux.Vars(request)["id"], 10, 64)
+		if err != nil {
+			http.Error(writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		revoked, err := s.sessionSvc.RevokeAll(request.Context(), kind, id)
+		s.audit(request, security.AuditSessionsRevoke, kind, mux.Vars(request)["id"], err)
+		if err != nil {
+			writeFail(writer, http.StatusInternalServerError, err)
+			return
+		}
+		parceJSON(writer, struct {
+			Revoked int64 `json:"revoked"`
+		}{Revoked: revoked})
+	}
+}
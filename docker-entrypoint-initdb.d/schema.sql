@@ -18,21 +18,30 @@ CREATE TABLE managers
     department TEXT default '',
     phone      TEXT      NOT NULL UNIQUE,
     password   TEXT default '',
-    roles      TEXT[]    NOT NULL                      DEFAULT '{}',
+    roles      TEXT[]    NOT NULL                      DEFAULT '{MANAGER}',
     active     BOOLEAN   NOT NULL                      DEFAULT TRUE,
-    created    TIMESTAMP NOT NULL                      DEFAULT CURRENT_TIMESTAMP
+    created    TIMESTAMP NOT NULL                      DEFAULT CURRENT_TIMESTAMP,
+    blocked_reason TEXT  NOT NULL                      DEFAULT '',
+    blocked_until  TIMESTAMP
 );
 
 CREATE TABLE customers
 (
     id       BIGSERIAL PRIMARY KEY,
     name     TEXT      NOT NULL,
-    phone    TEXT      NOT NULL UNIQUE,
+    phone    TEXT      NOT NULL,
     password TEXT      NOT NULL,
     active   BOOLEAN   NOT NULL DEFAULT TRUE,
-    created  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+    created  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    phone_verified BOOLEAN NOT NULL DEFAULT FALSE,
+    blocked_reason TEXT    NOT NULL DEFAULT '',
+    blocked_until  TIMESTAMP,
+    deleted        TIMESTAMP
 );
 
+-- номер удалённого покупателя можно зарегистрировать заново
+CREATE UNIQUE INDEX customers_phone_idx ON customers (phone) WHERE deleted IS NULL;
+
 CREATE TABLE sales
 (
     id          BIGSERIAL PRIMARY KEY,
@@ -49,22 +58,274 @@ CREATE TABLE sale_positions
     name       TEXT      NOT NULL default '',
     price      INTEGER   NOT NULL CHECK ( price > 0 ),
     qty        INTEGER   NOT NULL DEFAULT 0 CHECK ( qty >= 0 ),
-    created    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+    created    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    list_price INTEGER   NOT NULL DEFAULT 0,
+    price_override_by BIGINT REFERENCES managers
 );
 
 CREATE TABLE customers_tokens
 (
-    token       TEXT      NOT NULL UNIQUE,
+    id          BIGSERIAL PRIMARY KEY,
+    token_hash  TEXT      NOT NULL UNIQUE,
+    family      TEXT      NOT NULL,
     customer_id BIGINT    NOT NULL REFERENCES customers,
     expire      TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP + INTERVAL '1 hour',
-    created     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+    created     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    revoked     TIMESTAMP,
+    last_used   TIMESTAMP,
+    ip          TEXT      NOT NULL DEFAULT '',
+    user_agent  TEXT      NOT NULL DEFAULT '',
+    jti         TEXT
 );
 
 
 CREATE TABLE managers_tokens
 (
-    token       TEXT      NOT NULL UNIQUE,
+    id          BIGSERIAL PRIMARY KEY,
+    token_hash  TEXT      NOT NULL UNIQUE,
+    family      TEXT      NOT NULL,
     managers_id BIGINT    NOT NULL REFERENCES managers,
     expire      TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP + INTERVAL '1 hour',
+    created     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    revoked     TIMESTAMP,
+    last_used   TIMESTAMP,
+    ip          TEXT      NOT NULL DEFAULT '',
+    user_agent  TEXT      NOT NULL DEFAULT '',
+    jti         TEXT
+);
+
+CREATE TABLE refresh_tokens
+(
+    id         BIGSERIAL PRIMARY KEY,
+    token_hash TEXT      NOT NULL UNIQUE,
+    kind       TEXT      NOT NULL,
+    owner_id   BIGINT    NOT NULL,
+    family     TEXT      NOT NULL,
+    expire     TIMESTAMP NOT NULL,
+    rotated    TIMESTAMP,
+    revoked    TIMESTAMP,
+    created    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX refresh_tokens_family_idx ON refresh_tokens (family);
+
+CREATE TABLE login_attempts
+(
+    id      BIGSERIAL PRIMARY KEY,
+    kind    TEXT      NOT NULL,
+    phone   TEXT      NOT NULL,
+    ip      TEXT      NOT NULL DEFAULT '',
+    success BOOLEAN   NOT NULL,
+    created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX login_attempts_phone_idx ON login_attempts (kind, phone, created);
+CREATE INDEX login_attempts_ip_idx ON login_attempts (kind, ip, created);
+
+CREATE TABLE lockouts
+(
+    id       BIGSERIAL PRIMARY KEY,
+    kind     TEXT      NOT NULL,
+    scope    TEXT      NOT NULL CHECK ( scope IN ('phone', 'ip') ),
+    value    TEXT      NOT NULL,
+    failures INTEGER   NOT NULL,
+    until    TIMESTAMP NOT NULL,
+    created  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX lockouts_value_idx ON lockouts (kind, scope, value, until);
+
+CREATE TABLE managers_totp
+(
+    manager_id BIGINT PRIMARY KEY REFERENCES managers,
+    secret     TEXT      NOT NULL,
+    enabled    BOOLEAN   NOT NULL DEFAULT FALSE,
+    last_step  BIGINT    NOT NULL DEFAULT 0,
+    created    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE managers_recovery_codes
+(
+    id         BIGSERIAL PRIMARY KEY,
+    manager_id BIGINT    NOT NULL REFERENCES managers,
+    code_hash  TEXT      NOT NULL,
+    used       TIMESTAMP,
+    created    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE mfa_challenges
+(
+    id         BIGSERIAL PRIMARY KEY,
+    token_hash TEXT      NOT NULL UNIQUE,
+    manager_id BIGINT    NOT NULL REFERENCES managers,
+    attempts   INTEGER   NOT NULL DEFAULT 0,
+    expire     TIMESTAMP NOT NULL,
+    used       TIMESTAMP,
+    created    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE roles
+(
+    id          BIGSERIAL PRIMARY KEY,
+    name        TEXT      NOT NULL UNIQUE,
+    description TEXT      NOT NULL DEFAULT '',
     created     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
-)
\ No newline at end of file
+);
+
+CREATE TABLE permissions
+(
+    id          BIGSERIAL PRIMARY KEY,
+    name        TEXT NOT NULL UNIQUE,
+    description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE role_permissions
+(
+    role_id       BIGINT NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission_id BIGINT NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+INSERT INTO permissions(name, description)
+VALUES ('products:read', 'просмотр товаров'),
+       ('products:write', 'добавление и изменение товаров'),
+       ('products:delete', 'удаление товаров'),
+       ('customers:read', 'просмотр покупателей'),
+       ('customers:write', 'добавление и изменение покупателей'),
+       ('customers:delete', 'удаление покупателей'),
+       ('sales:read', 'просмотр своих продаж'),
+       ('sales:read:all', 'просмотр продаж всех менеджеров'),
+       ('sales:write', 'оформление продаж'),
+       ('sales:price_override', 'продажа по цене, отличной от цены товара'),
+       ('managers:read', 'просмотр менеджеров'),
+       ('managers:write', 'регистрация и изменение менеджеров'),
+       ('sessions:revoke', 'завершение сессий других пользователей'),
+       ('lockouts:read', 'просмотр блокировок входа'),
+       ('roles:read', 'просмотр ролей и прав'),
+       ('roles:write', 'управление ролями и их назначение'),
+       ('api_keys:read', 'просмотр API-ключей'),
+       ('api_keys:write', 'выпуск и отзыв API-ключей'),
+       ('api_keys:admin', 'выпуск API-ключей от имени других менеджеров'),
+       ('audit:read', 'просмотр журнала аудита');
+
+INSERT INTO roles(name, description)
+VALUES ('ADMIN', 'все права'),
+       ('MANAGER', 'работа с покупателями и продажами'),
+       ('PRICE_OVERRIDE', 'изменение цены при продаже');
+
+INSERT INTO role_permissions(role_id, permission_id)
+SELECT r.id, p.id FROM roles r, permissions p WHERE r.name = 'ADMIN';
+
+INSERT INTO role_permissions(role_id, permission_id)
+SELECT r.id, p.id FROM roles r, permissions p
+WHERE r.name = 'MANAGER'
+  AND p.name IN ('products:read', 'customers:read', 'customers:write', 'sales:read', 'sales:write');
+
+INSERT INTO role_permissions(role_id, permission_id)
+SELECT r.id, p.id FROM roles r, permissions p WHERE r.name = 'PRICE_OVERRIDE' AND p.name = 'sales:price_override';
+
+CREATE TABLE customers_deletion_requests
+(
+    id          BIGSERIAL PRIMARY KEY,
+    customer_id BIGINT    NOT NULL REFERENCES customers ON DELETE CASCADE,
+    reason      TEXT      NOT NULL DEFAULT '',
+    status      TEXT      NOT NULL DEFAULT 'pending' CHECK ( status IN ('pending', 'cancelled', 'completed') ),
+    created     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    processed   TIMESTAMP
+);
+
+CREATE UNIQUE INDEX customers_deletion_requests_pending_idx ON customers_deletion_requests (customer_id) WHERE status = 'pending';
+
+CREATE TABLE otp_codes
+(
+    id        BIGSERIAL PRIMARY KEY,
+    kind      TEXT      NOT NULL,
+    purpose   TEXT      NOT NULL,
+    phone     TEXT      NOT NULL,
+    owner_id  BIGINT    NOT NULL,
+    code_hash TEXT      NOT NULL,
+    attempts  INTEGER   NOT NULL DEFAULT 0,
+    expire    TIMESTAMP NOT NULL,
+    used      TIMESTAMP,
+    created   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX otp_codes_phone_idx ON otp_codes (kind, purpose, phone, created);
+
+CREATE TABLE password_history
+(
+    id       BIGSERIAL PRIMARY KEY,
+    kind     TEXT      NOT NULL,
+    owner_id BIGINT    NOT NULL,
+    hash     TEXT      NOT NULL,
+    created  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX password_history_owner_idx ON password_history (kind, owner_id, created);
+
+CREATE TABLE api_keys
+(
+    id          BIGSERIAL PRIMARY KEY,
+    name        TEXT      NOT NULL,
+    manager_id  BIGINT    NOT NULL REFERENCES managers,
+    prefix      TEXT      NOT NULL,
+    key_hash    TEXT      NOT NULL UNIQUE,
+    scopes      TEXT[]    NOT NULL DEFAULT '{}',
+    allowed_ips TEXT[]    NOT NULL DEFAULT '{}',
+    expire      TIMESTAMP,
+    last_used   TIMESTAMP,
+    last_ip     TEXT      NOT NULL DEFAULT '',
+    revoked     TIMESTAMP,
+    created     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE client_certificates
+(
+    id         BIGSERIAL PRIMARY KEY,
+    subject    TEXT      NOT NULL,
+    manager_id BIGINT REFERENCES managers,
+    api_key_id BIGINT REFERENCES api_keys,
+    last_used  TIMESTAMP,
+    revoked    TIMESTAMP,
+    created    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CHECK ( (manager_id IS NULL) <> (api_key_id IS NULL) )
+);
+
+CREATE UNIQUE INDEX client_certificates_subject_idx ON client_certificates (subject) WHERE revoked IS NULL;
+
+CREATE TABLE audit_events
+(
+    id          BIGSERIAL PRIMARY KEY,
+    actor_kind  TEXT      NOT NULL DEFAULT '',
+    actor_id    BIGINT,
+    action      TEXT      NOT NULL,
+    target_kind TEXT      NOT NULL DEFAULT '',
+    target_id   TEXT      NOT NULL DEFAULT '',
+    ip          TEXT      NOT NULL DEFAULT '',
+    user_agent  TEXT      NOT NULL DEFAULT '',
+    outcome     TEXT      NOT NULL,
+    details     TEXT      NOT NULL DEFAULT '',
+    created     TIMESTAMP NOT NULL,
+    prev_hash   TEXT      NOT NULL,
+    hash        TEXT      NOT NULL UNIQUE
+);
+
+CREATE INDEX audit_events_actor_idx ON audit_events (actor_kind, actor_id);
+CREATE INDEX audit_events_target_idx ON audit_events (target_kind, target_id);
+CREATE INDEX audit_events_created_idx ON audit_events (created);
+
+-- журнал только дополняется
+CREATE FUNCTION audit_events_append_only() RETURNS trigger AS
+$$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_events_append_only
+    BEFORE UPDATE OR DELETE ON audit_events
+    FOR EACH ROW EXECUTE PROCEDURE audit_events_append_only();
+
+CREATE TRIGGER audit_events_no_truncate
+    BEFORE TRUNCATE ON audit_events
+    FOR EACH STATEMENT EXECUTE PROCEDURE audit_events_append_only();
@@ -0,0 +1,75 @@
+package keyGen
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//GenClientCertificate выпускает клиентский сертификат для терминала, подписанный CA из GenCertificate.
+//В dir должны лежать ca.crt и ca-private.key, туда же пишутся <commonName>.crt и <commonName>-private.key.
+//CommonName затем привязывается к менеджеру или API-ключу через /api/managers/client-certificates
+func GenClientCertificate(dir string, commonName string, validFor time.Duration) error {
+	if commonName == "" || filepath.Base(commonName) != commonName {
+		return errors.New("invalid common name")
+	}
+	caBytes, err := os.ReadFile(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(caBytes)
+	if block == nil {
+		return errors.New("can't decode pem block")
+	}
+	ca, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+	caKeyBytes, err := os.ReadFile(filepath.Join(dir, "ca-private.key"))
+	if err != nil {
+		return err
+	}
+	caKey, err := decodePrivateKey(caKeyBytes)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return err
+	}
+	cert := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			Organization: ca.Subject.Organization,
+			Country:      ca.Subject.Country,
+		},
+		NotBefore:   time.Now(),
+		NotAfter:    time.Now().Add(validFor),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	}
+
+	certKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, cert, ca, &certKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+
+	err = encodePrivateKey(certKey, filepath.Join(dir, commonName+"-private.key"))
+	if err != nil {
+		return err
+	}
+	return encodeCert(certBytes, filepath.Join(dir, commonName+".crt"))
+}
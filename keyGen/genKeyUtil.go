@@ -8,6 +8,7 @@ import (
 	"encoding/pem"
 	"log"
 	"os"
+	"path/filepath"
 )
 
 func KeyGenInit() {
@@ -70,3 +71,12 @@ func encodePublicKey(key *rsa.PublicKey, path string) error {
 	}
 	return nil
 }
+
+//GenJWTKey создаёт ключ подписи access-токенов <dir>/<kid>.key для JWT_KEYS_DIR
+func GenJWTKey(dir string, kid string) error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	return encodePrivateKey(key, filepath.Join(dir, kid+".key"))
+}
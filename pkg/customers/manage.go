@@ -0,0 +1,229 @@
+package customers
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"github.com/sidalsoft/crud/pkg/security"
+	"log"
+	"strings"
+)
+
+const (
+	defaultLimit = 20
+	maxLimit     = 100
+)
+
+//Filter условия списка покупателей для менеджера. Query ищет по имени и телефону
+type Filter struct {
+	Query  string
+	Active *bool
+	Limit  int
+	Offset int
+}
+
+//Page страница списка и общее число покупателей под фильтром
+type Page struct {
+	Items  []*Customer `json:"items"`
+	Total  int64       `json:"total"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+}
+
+//Changes изменения покупателя менеджером. nil - поле остаётся как есть
+type Changes struct {
+	Name     *string
+	Phone    *string
+	Password *string
+}
+
+//Removal результат удаления. Soft - покупатель с продажами помечен удалённым, строка осталась
+type Removal struct {
+	ID   int64 `json:"id"`
+	Soft bool  `json:"soft"`
+}
+
+//List покупатели постранично, удалённые не показываются
+func (s *Service) List(ctx context.Context, filter *Filter) (*Page, error) {
+	if filter.Limit <= 0 || filter.Limit > maxLimit {
+		filter.Limit = defaultLimit
+	}
+	if filter.Offset < 0 {
+		filter.Offset = 0
+	}
+	where := `
+WHERE deleted IS NULL
+  AND ($1 = '' OR strpos(lower(name), lower($1)) > 0 OR strpos(phone, $1) > 0)
+  AND ($2::boolean IS NULL OR active = $2)`
+	args := []interface{}{strings.TrimSpace(filter.Query), filter.Active}
+
+	page := &Page{Items: make([]*Customer, 0), Limit: filter.Limit, Offset: filter.Offset}
+	err := s.pool.QueryRow(ctx, `SELECT count(*) FROM customers`+where, args...).Scan(&page.Total)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	rows, err := s.pool.Query(ctx, `SELECT id, name, phone, active, created FROM customers`+where+`
+ORDER BY id LIMIT $3 OFFSET $4`, append(args, filter.Limit, filter.Offset)...)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item := &Customer{}
+		err := rows.Scan(
+			&item.ID,
+			&item.Name,
+			&item.Phone,
+			&item.Active,
+			&item.Created,
+		)
+		if err != nil {
+			log.Println(err)
+			return nil, ErrInternal
+		}
+		page.Items = append(page.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return page, nil
+}
+
+//Update меняет только переданные поля одной транзакцией. Новый номер нужно подтвердить заново,
+//а новый пароль проходит политику и историю паролей и завершает все сессии покупателя:
+//если пароль не подошёл, остальные поля тоже не меняются
+func (s *Service) Update(ctx context.Context, id int64, changes *Changes) (*Customer, error) {
+	if changes.Name != nil {
+		name := strings.TrimSpace(*changes.Name)
+		if name == "" {
+			return nil, ErrInvalidName
+		}
+		changes.Name = &name
+	}
+	if changes.Phone != nil {
+		phone := strings.TrimSpace(*changes.Phone)
+		if phone == "" {
+			return nil, ErrInvalidPhone
+		}
+		changes.Phone = &phone
+	}
+	if changes.Password != nil {
+		if err := s.passwords.Validate(*changes.Password); err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			log.Println(err)
+		}
+	}()
+
+	item := &Customer{}
+	err = tx.QueryRow(ctx, `
+UPDATE customers SET name = COALESCE($2, name), phone = COALESCE($3, phone),
+                     phone_verified = phone_verified AND COALESCE($3, phone) = phone
+WHERE id = $1 AND deleted IS NULL
+  AND ($3::text IS NULL OR NOT EXISTS(SELECT 1 FROM customers WHERE phone = $3 AND id <> $1 AND deleted IS NULL))
+RETURNING id, name, phone, active, created`, id, changes.Name, changes.Phone).Scan(
+		&item.ID,
+		&item.Name,
+		&item.Phone,
+		&item.Active,
+		&item.Created)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, s.updateFailure(ctx, id)
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+
+	if changes.Password != nil {
+		if err := s.passwords.ChangeTx(ctx, tx, security.KindCustomer, id, *changes.Password); err != nil {
+			return nil, err
+		}
+		if _, err := s.sessionSvc.RevokeAllTx(ctx, tx, security.KindCustomer, id); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return item, nil
+}
+
+//updateFailure объясняет, почему Update не изменил строку: покупателя нет или номер занят
+func (s *Service) updateFailure(ctx context.Context, id int64) error {
+	var exists bool
+	err := s.pool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM customers WHERE id = $1 AND deleted IS NULL)`, id).Scan(&exists)
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	return ErrPhoneTaken
+}
+
+//Remove удаляет покупателя без продаж. Покупатель с продажами только помечается удалённым и отключается:
+//продажи должны сохранить ссылку на него
+func (s *Service) Remove(ctx context.Context, id int64) (*Removal, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && err != pgx.ErrTxClosed {
+			log.Println(err)
+		}
+	}()
+
+	var hasSales bool
+	err = tx.QueryRow(ctx, `
+SELECT EXISTS(SELECT 1 FROM sales WHERE customer_id = c.id) FROM customers c
+WHERE c.id = $1 AND c.deleted IS NULL FOR UPDATE`, id).Scan(&hasSales)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+
+	result := &Removal{ID: id, Soft: hasSales}
+	if hasSales {
+		_, err = tx.Exec(ctx, `UPDATE customers SET active = FALSE, deleted = CURRENT_TIMESTAMP WHERE id = $1`, id)
+	} else {
+		_, err = tx.Exec(ctx, `DELETE FROM customers_tokens WHERE customer_id = $1`, id)
+		if err == nil {
+			_, err = tx.Exec(ctx, `DELETE FROM customers WHERE id = $1`, id)
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+
+	//refresh-токены и прочие сессии хранятся без внешнего ключа, их достаточно отозвать
+	if _, err = s.sessionSvc.RevokeAll(ctx, security.KindCustomer, id); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
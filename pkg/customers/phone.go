@@ -0,0 +1,133 @@
+package customers
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"github.com/sidalsoft/crud/pkg/security"
+	"log"
+	"strings"
+)
+
+//ErrPhoneTaken номер уже принадлежит другому покупателю
+var ErrPhoneTaken = errors.New("phone already taken")
+
+//ErrInvalidPhone пустой номер
+var ErrInvalidPhone = errors.New("invalid phone")
+
+//StartPasswordReset отправляет код сброса пароля в фоне. Для незарегистрированного номера ничего не отправляется,
+//но ни ошибка, ни пауза между кодами, ни время ответа не выдают, какие номера зарегистрированы
+func (s *Service) StartPasswordReset(ctx context.Context, phone string) error {
+	phone = strings.TrimSpace(phone)
+	var id int64
+	err := s.pool.QueryRow(ctx, `SELECT id FROM customers WHERE phone = $1 AND deleted IS NULL`, phone).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	s.otpSvc.SendInBackground(security.KindCustomer, security.OTPPasswordReset, phone, id)
+	return nil
+}
+
+//ResetPassword задаёт новый пароль по коду из SMS и завершает все сессии покупателя.
+//Политика пароля проверяется до кода, а история паролей - до того, как код будет погашен,
+//чтобы из-за неподходящего пароля не приходилось запрашивать код заново
+func (s *Service) ResetPassword(ctx context.Context, phone string, code string, password string) error {
+	if err := s.passwords.Validate(password); err != nil {
+		return err
+	}
+	var id int64
+	err := s.otpSvc.Use(ctx, security.KindCustomer, security.OTPPasswordReset, strings.TrimSpace(phone), code, func(ownerID int64) error {
+		id = ownerID
+		return s.passwords.Change(ctx, security.KindCustomer, ownerID, password)
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.sessionSvc.RevokeAll(ctx, security.KindCustomer, id)
+	return err
+}
+
+//SendPhoneVerification отправляет в фоне код подтверждения номера, если номер зарегистрирован и ещё не подтверждён
+func (s *Service) SendPhoneVerification(ctx context.Context, phone string) error {
+	phone = strings.TrimSpace(phone)
+	var id int64
+	err := s.pool.QueryRow(ctx, `SELECT id FROM customers WHERE phone = $1 AND NOT phone_verified AND deleted IS NULL`, phone).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	s.otpSvc.SendInBackground(security.KindCustomer, security.OTPPhoneVerify, phone, id)
+	return nil
+}
+
+//VerifyPhone подтверждает номер по коду из SMS
+func (s *Service) VerifyPhone(ctx context.Context, phone string, code string) error {
+	phone = strings.TrimSpace(phone)
+	id, err := s.otpSvc.Verify(ctx, security.KindCustomer, security.OTPPhoneVerify, phone, code)
+	if err != nil {
+		return err
+	}
+	_, err = s.pool.Exec(ctx, `UPDATE customers SET phone_verified = TRUE WHERE id = $1 AND phone = $2`, id, phone)
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	return nil
+}
+
+//StartPhoneChange отправляет код на новый номер. Номер меняется только после ConfirmPhoneChange
+func (s *Service) StartPhoneChange(ctx context.Context, id int64, phone string) error {
+	phone = strings.TrimSpace(phone)
+	if phone == "" {
+		return ErrInvalidPhone
+	}
+	var taken bool
+	err := s.pool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM customers WHERE phone = $1 AND deleted IS NULL)`, phone).Scan(&taken)
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	if taken {
+		return ErrPhoneTaken
+	}
+	return s.otpSvc.Send(ctx, security.KindCustomer, security.OTPPhoneChange, phone, id)
+}
+
+//ConfirmPhoneChange меняет номер покупателя на подтверждённый кодом
+func (s *Service) ConfirmPhoneChange(ctx context.Context, id int64, phone string, code string) (*Customer, error) {
+	phone = strings.TrimSpace(phone)
+	ownerID, err := s.otpSvc.Verify(ctx, security.KindCustomer, security.OTPPhoneChange, phone, code)
+	if err != nil {
+		return nil, err
+	}
+	if ownerID != id {
+		return nil, security.ErrInvalidCode
+	}
+	item := &Customer{}
+	err = s.pool.QueryRow(ctx, `
+UPDATE customers SET phone = $2, phone_verified = TRUE
+WHERE id = $1 AND NOT EXISTS(SELECT 1 FROM customers WHERE phone = $2 AND id <> $1 AND deleted IS NULL)
+RETURNING id, name, phone, active, created`, id, phone).Scan(
+		&item.ID,
+		&item.Name,
+		&item.Phone,
+		&item.Active,
+		&item.Created)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrPhoneTaken
+	}
+
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return item, nil
+}
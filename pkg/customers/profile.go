@@ -0,0 +1,179 @@
+package customers
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"github.com/sidalsoft/crud/pkg/security"
+	"log"
+	"strings"
+	"time"
+)
+
+//ErrDeletionRequested у покупателя уже есть необработанный запрос на удаление
+var ErrDeletionRequested = errors.New("deletion already requested")
+
+//ErrInvalidName ...
+var ErrInvalidName = errors.New("invalid name")
+
+//DeletionRequest запрос покупателя на удаление аккаунта, обрабатывается менеджером
+type DeletionRequest struct {
+	ID         int64      `json:"id"`
+	CustomerId int64      `json:"customerId"`
+	Reason     string     `json:"reason"`
+	Status     string     `json:"status"`
+	Created    time.Time  `json:"created"`
+	Processed  *time.Time `json:"processed"`
+}
+
+//Статусы запроса на удаление
+const (
+	DeletionPending   = "pending"
+	DeletionCancelled = "cancelled"
+	DeletionCompleted = "completed"
+)
+
+//UpdateProfile меняет данные профиля, которые покупатель может менять сам
+func (s *Service) UpdateProfile(ctx context.Context, id int64, name string) (*Customer, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, ErrInvalidName
+	}
+	item := &Customer{}
+	err := s.pool.QueryRow(ctx, `
+UPDATE customers SET name = $2 WHERE id = $1 RETURNING id, name, phone, active, created`, id, name).Scan(
+		&item.ID,
+		&item.Name,
+		&item.Phone,
+		&item.Active,
+		&item.Created)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return item, nil
+}
+
+//ChangePassword меняет пароль после проверки текущего и в той же транзакции завершает все сессии покупателя.
+//Неверный текущий пароль учитывается как неудачный вход, чтобы его нельзя было подбирать через этот метод
+func (s *Service) ChangePassword(ctx context.Context, id int64, oldPassword string, newPassword string, client *security.Client) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			log.Println(err)
+		}
+	}()
+
+	var phone, hash string
+	err = tx.QueryRow(ctx, `SELECT phone, password FROM customers WHERE id = $1 AND deleted IS NULL FOR UPDATE`, id).Scan(&phone, &hash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	if err := s.throttle.Check(ctx, security.KindCustomer, phone, client); err != nil {
+		return err
+	}
+	if !s.passwords.Compare(hash, oldPassword) {
+		s.throttle.Fail(ctx, security.KindCustomer, phone, client)
+		return security.ErrInvalidPassword
+	}
+	s.throttle.Succeed(ctx, security.KindCustomer, phone, client)
+
+	if err := s.passwords.ChangeTx(ctx, tx, security.KindCustomer, id, newPassword); err != nil {
+		return err
+	}
+	if _, err := s.sessionSvc.RevokeAllTx(ctx, tx, security.KindCustomer, id); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	return nil
+}
+
+//RequestDeletion регистрирует запрос на удаление аккаунта
+func (s *Service) RequestDeletion(ctx context.Context, id int64, reason string) (*DeletionRequest, error) {
+	item := &DeletionRequest{}
+	err := s.pool.QueryRow(ctx, `
+INSERT INTO customers_deletion_requests(customer_id, reason) VALUES($1, $2)
+ON CONFLICT (customer_id) WHERE status = 'pending' DO NOTHING
+RETURNING id, customer_id, reason, status, created, processed`, id, strings.TrimSpace(reason)).Scan(
+		&item.ID,
+		&item.CustomerId,
+		&item.Reason,
+		&item.Status,
+		&item.Created,
+		&item.Processed)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrDeletionRequested
+	}
+
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return item, nil
+}
+
+//DeletionRequest последний запрос покупателя на удаление аккаунта
+func (s *Service) DeletionRequest(ctx context.Context, id int64) (*DeletionRequest, error) {
+	item := &DeletionRequest{}
+	err := s.pool.QueryRow(ctx, `
+SELECT id, customer_id, reason, status, created, processed FROM customers_deletion_requests
+WHERE customer_id = $1 ORDER BY created DESC LIMIT 1`, id).Scan(
+		&item.ID,
+		&item.CustomerId,
+		&item.Reason,
+		&item.Status,
+		&item.Created,
+		&item.Processed)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return item, nil
+}
+
+//CancelDeletion отменяет необработанный запрос на удаление
+func (s *Service) CancelDeletion(ctx context.Context, id int64) (*DeletionRequest, error) {
+	item := &DeletionRequest{}
+	err := s.pool.QueryRow(ctx, `
+UPDATE customers_deletion_requests SET status = 'cancelled', processed = CURRENT_TIMESTAMP
+WHERE customer_id = $1 AND status = 'pending'
+RETURNING id, customer_id, reason, status, created, processed`, id).Scan(
+		&item.ID,
+		&item.CustomerId,
+		&item.Reason,
+		&item.Status,
+		&item.Created,
+		&item.Processed)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return item, nil
+}
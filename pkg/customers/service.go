@@ -5,7 +5,8 @@ import (
 	"errors"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/sidalsoft/crud/pkg/security"
+	"github.com/sidalsoft/crud/pkg/security/password"
 	"log"
 	"time"
 )
@@ -19,12 +20,17 @@ var ErrInternal = errors.New("internal error")
 //Service ..
 type Service struct {
 	//db *sql.DB
-	pool *pgxpool.Pool
+	pool       *pgxpool.Pool
+	sessionSvc *security.SessionService
+	otpSvc     *security.OTPService
+	passwords  *password.Service
+	throttle   *security.LoginThrottle
 }
 
 //NewService ..
-func NewService(pool *pgxpool.Pool) *Service {
-	return &Service{pool: pool}
+func NewService(pool *pgxpool.Pool, sessionSvc *security.SessionService, otpSvc *security.OTPService,
+	passwords *password.Service, throttle *security.LoginThrottle) *Service {
+	return &Service{pool: pool, sessionSvc: sessionSvc, otpSvc: otpSvc, passwords: passwords, throttle: throttle}
 }
 
 //Customer ...
@@ -32,14 +38,14 @@ type Customer struct {
 	ID       int64     `json:"id"`
 	Name     string    `json:"name"`
 	Phone    string    `json:"phone"`
-	Password string    `json:"password"`
+	Password string    `json:"-"`
 	Active   bool      `json:"active"`
 	Created  time.Time `json:"created"`
 }
 
 func (s *Service) All(ctx context.Context) (cs []*Customer, err error) {
 
-	sqlStatement := `select * from customers`
+	sqlStatement := `select id, name, phone, active, created from customers where deleted is null`
 
 	rows, err := s.pool.Query(ctx, sqlStatement)
 	if err != nil {
@@ -66,7 +72,7 @@ func (s *Service) All(ctx context.Context) (cs []*Customer, err error) {
 }
 
 func (s *Service) AllActive(ctx context.Context) (cs []*Customer, err error) {
-	rows, err := s.pool.Query(ctx, `select * from customers where active=true`)
+	rows, err := s.pool.Query(ctx, `select id, name, phone, active, created from customers where active=true and deleted is null`)
 	if err != nil {
 		return nil, err
 	}
@@ -99,7 +105,7 @@ func (s *Service) ByID(ctx context.Context, id int64) (*Customer, error) {
 	item := &Customer{}
 
 	err := s.pool.QueryRow(ctx, `
-SELECT id, name, phone, active, created FROM customers WHERE id=$1`, id).Scan(
+SELECT id, name, phone, active, created FROM customers WHERE id=$1 AND deleted IS NULL`, id).Scan(
 		&item.ID,
 		&item.Name,
 		&item.Phone,
@@ -118,101 +124,27 @@ SELECT id, name, phone, active, created FROM customers WHERE id=$1`, id).Scan(
 
 }
 
-func (s *Service) ChangeActive(ctx context.Context, id int64, active bool) (*Customer, error) {
-	item := &Customer{}
-
-	err := s.pool.QueryRow(ctx, `
-UPDATE customers SET active=$2 WHERE id=$1 RETURNING *`, id, active).Scan(
-		&item.ID,
-		&item.Name,
-		&item.Phone,
-		&item.Active,
-		&item.Created)
-
-	if errors.Is(err, pgx.ErrNoRows) {
-		return nil, ErrNotFound
-	}
-
+//Save регистрирует нового покупателя. Имя, номер и пароль существующего покупателя
+//меняются только через Update, UpdateProfile, подтверждение номера и смену пароля
+func (s *Service) Save(ctx context.Context, customer *Customer) (*Customer, error) {
+	hash, err := s.passwords.Hash(customer.Password)
 	if err != nil {
-		log.Println(err)
-		return nil, ErrInternal
+		return nil, err
 	}
-	return item, nil
-
-}
-
-func (s *Service) Delete(ctx context.Context, id int64) (*Customer, error) {
 	item := &Customer{}
-
-	err := s.pool.QueryRow(ctx, `
-DELETE FROM customers  WHERE id=$1 RETURNING *`, id).Scan(
+	err = s.pool.QueryRow(ctx, `INSERT INTO customers(name, phone, password) values($1, $2, $3) RETURNING id, name, phone, active, created`, customer.Name, customer.Phone, hash).Scan(
 		&item.ID,
 		&item.Name,
 		&item.Phone,
 		&item.Active,
 		&item.Created)
-
-	if errors.Is(err, pgx.ErrNoRows) {
-		return nil, ErrNotFound
-	}
-
-	if err != nil {
-		log.Println(err)
-		return nil, ErrInternal
-	}
-	return item, nil
-
-}
-
-func (s *Service) Save(ctx context.Context, customer *Customer) (c *Customer, err error) {
-
-	item := &Customer{}
-
-	if customer.ID == 0 {
-		err = s.pool.QueryRow(ctx, `INSERT INTO customers(name, phone, password) values($1, $2, $3) RETURNING *`, customer.Name, customer.Phone, hashPassword(customer.Password)).Scan(
-			&item.ID,
-			&item.Name,
-			&item.Phone,
-			&item.Password,
-			&item.Active,
-			&item.Created)
-	} else {
-		err = s.pool.QueryRow(ctx, `UPDATE customers SET name=$1, phone=$2, password=$3 where id=$4 RETURNING *`, customer.Name, customer.Phone, hashPassword(customer.Password), customer.ID).Scan(
-			&item.ID,
-			&item.Name,
-			&item.Phone,
-			&item.Active,
-			&item.Created)
-	}
-
-	if errors.Is(err, pgx.ErrNoRows) {
-		return nil, ErrNotFound
-	}
-
 	if err != nil {
 		log.Println(err)
 		return nil, ErrInternal
 	}
 	return item, nil
-
 }
 
 func (s *Service) IDByToken(ctx context.Context, token string) (int64, error) {
-	var id int64
-	err := s.pool.QueryRow(ctx, "SELECT customer_id FROM customers_tokens WHERE token = $1", token).Scan(&id)
-	if err == pgx.ErrNoRows {
-		return 0, nil
-	}
-	if err != nil {
-		return 0, err
-	}
-	return id, nil
-}
-
-func hashPassword(pass string) string {
-	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
-	if err != nil {
-		log.Print(err)
-	}
-	return string(hash)
+	return s.sessionSvc.OwnerByToken(ctx, security.KindCustomer, token)
 }
@@ -0,0 +1,84 @@
+package managers
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"github.com/sidalsoft/crud/pkg/security"
+	"log"
+)
+
+//ErrAlreadyBootstrapped первый администратор уже создан
+var ErrAlreadyBootstrapped = errors.New("managers already exist")
+
+//HasManagers есть ли в базе хоть один менеджер
+func (s *ManagersService) HasManagers(ctx context.Context) (bool, error) {
+	var exists bool
+	err := s.pool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM managers)`).Scan(&exists)
+	if err != nil {
+		log.Println(err)
+		return false, ErrInternal
+	}
+	return exists, nil
+}
+
+//CreateAdmin создаёт менеджера с ролью ADMIN в дополнение к переданным ролям
+func (s *ManagersService) CreateAdmin(ctx context.Context, item *Managers) (*Managers, error) {
+	item.ID = 0
+	item.Roles = append([]string{security.RoleAdmin}, item.Roles...)
+	return s.Save(ctx, item)
+}
+
+//CreateFirstAdmin создаёт администратора, только пока в базе нет ни одного менеджера
+func (s *ManagersService) CreateFirstAdmin(ctx context.Context, item *Managers) (*Managers, error) {
+	roles, err := s.rbacSvc.ResolveRoles(ctx, append([]string{security.RoleAdmin}, item.Roles...))
+	if err != nil {
+		return nil, err
+	}
+	hash, err := s.passwords.Hash(item.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && err != pgx.ErrTxClosed {
+			log.Println(err)
+		}
+	}()
+
+	//два одновременных запроса не должны создать двух первых администраторов
+	_, err = tx.Exec(ctx, `LOCK TABLE managers IN SHARE ROW EXCLUSIVE MODE`)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	var exists bool
+	err = tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM managers)`).Scan(&exists)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	if exists {
+		return nil, ErrAlreadyBootstrapped
+	}
+
+	result, err := scanManager(tx.QueryRow(ctx, `INSERT INTO managers(name, phone, roles, password) values($1, $2, $3, $4) RETURNING `+managerColumns,
+		item.Name, item.Phone, roles, hash))
+	if isPhoneTaken(err) {
+		return nil, ErrPhoneTaken
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return result, nil
+}
@@ -2,15 +2,14 @@ package managers
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/hex"
 	"errors"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/sidalsoft/crud/cmd/app/middleware"
 	"github.com/sidalsoft/crud/pkg/security"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/sidalsoft/crud/pkg/security/password"
 	"log"
+	"strings"
 	"time"
 )
 
@@ -20,15 +19,43 @@ var ErrNotFound = errors.New("item not found")
 //ErrInternal ...
 var ErrInternal = errors.New("internal error")
 
+//ErrInvalidBoss руководитель не найден или назначение создаёт цикл подчинения
+var ErrInvalidBoss = errors.New("invalid boss")
+
+//ErrInvalidManager ...
+var ErrInvalidManager = errors.New("invalid manager")
+
+//ErrPhoneTaken номер уже принадлежит другому менеджеру
+var ErrPhoneTaken = errors.New("phone already taken")
+
+//uniqueViolation код ошибки PostgreSQL при нарушении UNIQUE
+const uniqueViolation = "23505"
+
+//isPhoneTaken у менеджера уникален только телефон, поэтому любое нарушение UNIQUE - занятый номер
+func isPhoneTaken(err error) bool {
+	var pgErr interface{ SQLState() string }
+	return errors.As(err, &pgErr) && pgErr.SQLState() == uniqueViolation
+}
+
 //Service ..
 type ManagersService struct {
 	//db *sql.DB
-	pool *pgxpool.Pool
+	pool       *pgxpool.Pool
+	sessionSvc *security.SessionService
+	throttle   *security.LoginThrottle
+	mfaSvc     *security.MFAService
+	rbacSvc    *security.RBACService
+	otpSvc     *security.OTPService
+	passwords  *password.Service
+	blocks     *security.BlockService
 }
 
 //NewService ..
-func NewManagersService(pool *pgxpool.Pool) *ManagersService {
-	return &ManagersService{pool: pool}
+func NewManagersService(pool *pgxpool.Pool, sessionSvc *security.SessionService, throttle *security.LoginThrottle,
+	mfaSvc *security.MFAService, rbacSvc *security.RBACService, otpSvc *security.OTPService,
+	passwords *password.Service, blocks *security.BlockService) *ManagersService {
+	return &ManagersService{pool: pool, sessionSvc: sessionSvc, throttle: throttle, mfaSvc: mfaSvc, rbacSvc: rbacSvc,
+		otpSvc: otpSvc, passwords: passwords, blocks: blocks}
 }
 
 //Managers ...
@@ -40,51 +67,28 @@ type Managers struct {
 	BossId     *int64    `json:"bossId"`
 	Department string    `json:"department"`
 	Phone      string    `json:"phone"`
-	Password   string    `json:"password"`
+	Password   string    `json:"-"`
 	Roles      []string  `json:"roles"`
 	Active     bool      `json:"active"`
 	Created    time.Time `json:"created"`
 }
 
-func (s *ManagersService) All(ctx context.Context) (cs []*Managers, err error) {
-
-	sqlStatement := `select * from managers`
-
-	rows, err := s.pool.Query(ctx, sqlStatement)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		item := &Managers{}
-		err := rows.Scan(
-			&item.ID,
-			&item.Name,
-			&item.Salary,
-			&item.Plan,
-			&item.BossId,
-			&item.Department,
-			&item.Phone,
-			&item.Password,
-			&item.Roles,
-			&item.Active,
-			&item.Created,
-		)
-		if err != nil {
-			log.Println(err)
-		}
-		cs = append(cs, item)
+//Validate проверяет менеджера целиком: имя, телефон и хотя бы одна роль обязательны,
+//зарплата и план должны быть положительными
+func (m *Managers) Validate() error {
+	if strings.TrimSpace(m.Name) == "" || strings.TrimSpace(m.Phone) == "" || len(m.Roles) == 0 ||
+		m.Salary <= 0 || m.Plan <= 0 {
+		return ErrInvalidManager
 	}
-
-	return cs, nil
+	return nil
 }
 
-func (s *ManagersService) ByID(ctx context.Context, id int64) (*Managers, error) {
-	item := &Managers{}
+//managerColumns столбцы менеджера в порядке полей Managers. Хэш пароля не читается, чтобы не попасть в ответ
+const managerColumns = `id, name, salary, plan, boss_id, department, phone, roles, active, created`
 
-	err := s.pool.QueryRow(ctx, `
-SELECT id, name, salary, plan, boss_id, department, login, roles, active, created FROM managers WHERE id=$1`, id).Scan(
+func scanManager(row pgx.Row) (*Managers, error) {
+	item := &Managers{}
+	err := row.Scan(
 		&item.ID,
 		&item.Name,
 		&item.Salary,
@@ -92,39 +96,40 @@ SELECT id, name, salary, plan, boss_id, department, login, roles, active, create
 		&item.BossId,
 		&item.Department,
 		&item.Phone,
-		&item.Password,
 		&item.Roles,
 		&item.Active,
-		&item.Created)
-
-	if errors.Is(err, pgx.ErrNoRows) {
-		return nil, ErrNotFound
-	}
+		&item.Created,
+	)
+	return item, err
+}
 
+//All все менеджеры
+func (s *ManagersService) All(ctx context.Context) ([]*Managers, error) {
+	rows, err := s.pool.Query(ctx, `SELECT `+managerColumns+` FROM managers ORDER BY id`)
 	if err != nil {
 		log.Println(err)
 		return nil, ErrInternal
 	}
-	return item, nil
+	defer rows.Close()
 
+	items := make([]*Managers, 0)
+	for rows.Next() {
+		item, err := scanManager(rows)
+		if err != nil {
+			log.Println(err)
+			return nil, ErrInternal
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return items, nil
 }
 
-func (s *ManagersService) ChangeActive(ctx context.Context, id int64, active bool) (*Managers, error) {
-	item := &Managers{}
-
-	err := s.pool.QueryRow(ctx, `
-UPDATE managers SET active=$2 WHERE id=$1 RETURNING *`, id, active).Scan(
-		&item.ID,
-		&item.Name,
-		&item.Salary,
-		&item.Plan,
-		&item.BossId,
-		&item.Department,
-		&item.Phone,
-		&item.Password,
-		&item.Roles,
-		&item.Active,
-		&item.Created)
+func (s *ManagersService) ByID(ctx context.Context, id int64) (*Managers, error) {
+	item, err := scanManager(s.pool.QueryRow(ctx, `SELECT `+managerColumns+` FROM managers WHERE id=$1`, id))
 
 	if errors.Is(err, pgx.ErrNoRows) {
 		return nil, ErrNotFound
@@ -138,22 +143,26 @@ UPDATE managers SET active=$2 WHERE id=$1 RETURNING *`, id, active).Scan(
 
 }
 
-func (s *ManagersService) Delete(ctx context.Context, id int64) (*Managers, error) {
-	item := &Managers{}
+//ChangeActive включает или отключает менеджера. Отключение идёт через BlockService, чтобы завершить его сессии
+func (s *ManagersService) ChangeActive(ctx context.Context, id int64, active bool) (*Managers, error) {
+	var err error
+	if active {
+		_, err = s.blocks.Unblock(ctx, security.KindManager, id)
+	} else {
+		_, err = s.blocks.Block(ctx, security.KindManager, id, "", nil)
+	}
+	if errors.Is(err, security.ErrNoSuchUser) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.ByID(ctx, id)
+}
 
-	err := s.pool.QueryRow(ctx, `
-DELETE FROM managers  WHERE id=$1 RETURNING *`, id).Scan(
-		&item.ID,
-		&item.Name,
-		&item.Salary,
-		&item.Plan,
-		&item.BossId,
-		&item.Department,
-		&item.Phone,
-		&item.Password,
-		&item.Roles,
-		&item.Active,
-		&item.Created)
+func (s *ManagersService) Delete(ctx context.Context, id int64) (*Managers, error) {
+	item, err := scanManager(s.pool.QueryRow(ctx, `
+DELETE FROM managers  WHERE id=$1 RETURNING `+managerColumns, id))
 
 	if errors.Is(err, pgx.ErrNoRows) {
 		return nil, ErrNotFound
@@ -167,39 +176,83 @@ DELETE FROM managers  WHERE id=$1 RETURNING *`, id).Scan(
 
 }
 
-func (s *ManagersService) Save(ctx context.Context, customer *Managers) (c *Managers, err error) {
-	item := &Managers{}
-	if customer.ID == 0 {
-		err = s.pool.QueryRow(ctx, `INSERT INTO managers(name, phone, roles, password) values($1, $2, $3, $4) RETURNING *`, customer.Name, customer.Phone, customer.Roles, hashPassword(customer.Password)).Scan(
-			&item.ID,
-			&item.Name,
-			&item.Salary,
-			&item.Plan,
-			&item.BossId,
-			&item.Department,
-			&item.Phone,
-			&item.Password,
-			&item.Roles,
-			&item.Active,
-			&item.Created)
+//checkBoss проверяет, что руководитель существует и назначение не замкнёт цепочку подчинения на самого менеджера
+func (s *ManagersService) checkBoss(ctx context.Context, id int64, bossID *int64) error {
+	if bossID == nil {
+		return nil
+	}
+	if *bossID == id {
+		return ErrInvalidBoss
+	}
+	var exists, cycle bool
+	err := s.pool.QueryRow(ctx, `
+WITH RECURSIVE chain AS (
+    SELECT id, boss_id FROM managers WHERE id = $1
+    UNION
+    SELECT m.id, m.boss_id FROM managers m JOIN chain c ON m.id = c.boss_id
+)
+SELECT EXISTS(SELECT 1 FROM chain WHERE id = $1), EXISTS(SELECT 1 FROM chain WHERE id = $2)`, *bossID, id).
+		Scan(&exists, &cycle)
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	if !exists || cycle {
+		return ErrInvalidBoss
+	}
+	return nil
+}
+
+//Save создаёт менеджера или меняет его данные. При изменении пароль не трогается,
+//роли меняются, только если переданы, а нулевые зарплата и план оставляют текущие значения
+func (s *ManagersService) Save(ctx context.Context, manager *Managers) (*Managers, error) {
+	if manager.ID == 0 && len(manager.Roles) == 0 {
+		manager.Roles = []string{security.RoleManager}
+	}
+	if manager.Salary < 0 || manager.Plan < 0 {
+		return nil, ErrInvalidManager
+	}
+	var err error
+	if len(manager.Roles) == 0 {
+		//NULL в запросе оставляет текущие роли
+		manager.Roles = nil
+	} else {
+		manager.Roles, err = s.rbacSvc.ResolveRoles(ctx, manager.Roles)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := s.checkBoss(ctx, manager.ID, manager.BossId); err != nil {
+		return nil, err
+	}
+
+	var item *Managers
+	if manager.ID == 0 {
+		var hash string
+		hash, err = s.passwords.Hash(manager.Password)
+		if err != nil {
+			return nil, err
+		}
+		item, err = scanManager(s.pool.QueryRow(ctx, `
+INSERT INTO managers(name, phone, roles, password, salary, plan, boss_id, department)
+values($1, $2, $3, $4, COALESCE(NULLIF($5, 0), 1), COALESCE(NULLIF($6, 0), 1), $7, $8)
+RETURNING `+managerColumns,
+			manager.Name, manager.Phone, manager.Roles, hash, manager.Salary, manager.Plan, manager.BossId, manager.Department))
 	} else {
-		err = s.pool.QueryRow(ctx, `UPDATE managers SET name=$1, phone=$2, roles=$3 where id=$4 RETURNING *`, customer.Name, customer.Phone, customer.Roles, customer.ID).Scan(
-			&item.ID,
-			&item.Name,
-			&item.Salary,
-			&item.Plan,
-			&item.BossId,
-			&item.Department,
-			&item.Phone,
-			&item.Password,
-			&item.Roles,
-			&item.Active,
-			&item.Created)
+		item, err = scanManager(s.pool.QueryRow(ctx, `
+UPDATE managers SET name=$1, phone=$2, roles=COALESCE($3, roles), salary=COALESCE(NULLIF($4, 0), salary),
+                    plan=COALESCE(NULLIF($5, 0), plan), boss_id=$6, department=$7
+where id=$8 RETURNING `+managerColumns,
+			manager.Name, manager.Phone, manager.Roles, manager.Salary, manager.Plan, manager.BossId, manager.Department,
+			manager.ID))
 	}
 
 	if errors.Is(err, pgx.ErrNoRows) {
 		return nil, ErrNotFound
 	}
+	if isPhoneTaken(err) {
+		return nil, ErrPhoneTaken
+	}
 
 	if err != nil {
 		log.Println(err)
@@ -210,70 +263,142 @@ func (s *ManagersService) Save(ctx context.Context, customer *Managers) (c *Mana
 }
 
 func (s *ManagersService) IDByToken(ctx context.Context, token string) (int64, error) {
-	var id int64
-	err := s.pool.QueryRow(ctx, "SELECT managers_id FROM managers_tokens WHERE token = $1", token).Scan(&id)
-	if err == pgx.ErrNoRows {
-		return 0, nil
-	}
-	if err != nil {
-		return 0, err
-	}
-	return id, nil
+	return s.sessionSvc.OwnerByToken(ctx, security.KindManager, token)
 }
 
-func (s *ManagersService) HasAnyRole(ctx context.Context, role string) bool {
-	var aRoles []string
-	id, err := middleware.Authentication(ctx)
-	if err != nil {
-		return false
+//Permissions права менеджера по его текущим ролям в базе, в том числе для подписанного токена:
+//снятая роль перестаёт действовать сразу, а не после истечения токена
+func (s *ManagersService) Permissions(ctx context.Context, principal *middleware.Principal) ([]string, error) {
+	if principal.Kind != "" && principal.Kind != security.KindManager {
+		return nil, nil
 	}
-	err = s.pool.QueryRow(ctx, "SELECT roles FROM managers WHERE id = $1", id).Scan(&aRoles)
-	if err == pgx.ErrNoRows {
-		return false
+	permissions, err := s.rbacSvc.ManagerPermissions(ctx, principal.ID)
+	if err != nil || principal.APIKeyID == 0 {
+		return permissions, err
 	}
-	if err != nil {
-		return false
+	//API-ключ не может дать больше прав, чем есть у владельца сейчас
+	scopes := make(map[string]bool, len(principal.Scopes))
+	for _, scope := range principal.Scopes {
+		scopes[scope] = true
 	}
-	for _, v := range aRoles {
-		if v == role {
-			return true
+	result := make([]string, 0, len(permissions))
+	for _, permission := range permissions {
+		if scopes[permission] {
+			result = append(result, permission)
 		}
 	}
-	return false
+	return result, nil
 }
 
-func (s *ManagersService) TokenForManager(ctx context.Context, phone string, password string) (token string, err error) {
+//TokenForManager проверяет пароль и выдаёт токены. Если у менеджера подключён или обязателен TOTP,
+//вместо токенов возвращается MFA-запрос, который завершается через TokenForChallenge
+func (s *ManagersService) TokenForManager(ctx context.Context, phone string, pass string, client *security.Client) (*security.LoginResult, error) {
+	if err := s.throttle.Check(ctx, security.KindManager, phone, client); err != nil {
+		return nil, err
+	}
+	//после перебора кодов второго шага новые MFA-запросы не выдаются, пока не пройдёт блокировка
+	if err := s.throttle.Check(ctx, security.ThrottleKindMFA, phone, client); err != nil {
+		return nil, err
+	}
 	var hash string
 	var id int64
-	err = s.pool.QueryRow(ctx, `SELECT id, password FROM managers WHERE phone = $1`, phone).
+	err := s.pool.QueryRow(ctx, `SELECT id, password FROM managers WHERE phone = $1`, phone).
 		Scan(&id, &hash)
 	if err == pgx.ErrNoRows {
-		return "", security.ErrNoSuchUser
+		s.passwords.CompareDummy(pass)
+		s.throttle.Fail(ctx, security.KindManager, phone, client)
+		return nil, security.ErrNoSuchUser
 	}
 	if err != nil {
-		return "", ErrInternal
+		return nil, ErrInternal
+	}
+
+	if !s.passwords.Compare(hash, pass) {
+		s.throttle.Fail(ctx, security.KindManager, phone, client)
+		return nil, security.ErrInvalidPassword
+	}
+	s.throttle.Succeed(ctx, security.KindManager, phone, client)
+	s.passwords.Rehash(ctx, security.KindManager, id, pass, hash)
+	if err := s.blocks.Check(ctx, security.KindManager, id); err != nil {
+		return nil, err
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	challenge, err := s.mfaSvc.Challenge(ctx, id)
 	if err != nil {
-		return "", security.ErrInvalidPassword
+		return nil, err
 	}
-	buffer := make([]byte, 256)
-	n, err := rand.Read(buffer)
-	if n != len(buffer) || err != nil {
-		return "", ErrInternal
+	if challenge != nil {
+		return &security.LoginResult{MFA: challenge}, nil
 	}
-	token = hex.EncodeToString(buffer)
-	_, err = s.pool.Exec(ctx, `INSERT INTO managers_tokens(token, managers_id) VALUES($1,$2)`, token, id)
+	token, err := s.sessionSvc.Create(ctx, security.KindManager, id, client)
 	if err != nil {
-		return "", ErrInternal
+		return nil, err
 	}
-	return token, nil
+	return &security.LoginResult{TokenPair: token}, nil
 }
-func hashPassword(pass string) string {
-	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+
+//TokenForChallenge завершает вход с TOTP-кодом или кодом восстановления.
+//Неверные коды учитываются по менеджеру, как неверные пароли: число MFA-запросов на один пароль не ограничено,
+//поэтому лимита попыток одного запроса недостаточно
+func (s *ManagersService) TokenForChallenge(ctx context.Context, challenge string, code string, recoveryCode string, client *security.Client) (*security.LoginResult, error) {
+	phone, err := s.mfaSvc.ChallengePhone(ctx, challenge)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.throttle.Check(ctx, security.ThrottleKindMFA, phone, client); err != nil {
+		return nil, err
+	}
+	id, codes, err := s.mfaSvc.CompleteChallenge(ctx, challenge, code, recoveryCode)
+	if errors.Is(err, security.ErrInvalidCode) || errors.Is(err, security.ErrTooManyCodeAttempts) {
+		s.throttle.Fail(ctx, security.ThrottleKindMFA, phone, client)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.throttle.Succeed(ctx, security.ThrottleKindMFA, phone, client)
+	//менеджера могли заблокировать, пока он вводил код
+	if err := s.blocks.Check(ctx, security.KindManager, id); err != nil {
+		return nil, err
+	}
+	token, err := s.sessionSvc.Create(ctx, security.KindManager, id, client)
+	if err != nil {
+		return nil, err
+	}
+	return &security.LoginResult{TokenPair: token, RecoveryCodes: codes}, nil
+}
+
+//StartPasswordReset отправляет в фоне код сброса пароля, если номер принадлежит менеджеру.
+//Ответ одинаков для любого номера, как и у покупателей
+func (s *ManagersService) StartPasswordReset(ctx context.Context, phone string) error {
+	phone = strings.TrimSpace(phone)
+	var id int64
+	err := s.pool.QueryRow(ctx, `SELECT id FROM managers WHERE phone = $1`, phone).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	s.otpSvc.SendInBackground(security.KindManager, security.OTPPasswordReset, phone, id)
+	return nil
+}
+
+//ResetPassword задаёт новый пароль по коду из SMS и завершает все сессии менеджера.
+//Пароль из истории отклоняется до того, как код будет погашен. Второй фактор при этом не отключается
+func (s *ManagersService) ResetPassword(ctx context.Context, phone string, code string, pass string) error {
+	if err := s.passwords.Validate(pass); err != nil {
+		return err
+	}
+	var id int64
+	err := s.otpSvc.Use(ctx, security.KindManager, security.OTPPasswordReset, strings.TrimSpace(phone), code, func(ownerID int64) error {
+		id = ownerID
+		return s.passwords.Change(ctx, security.KindManager, ownerID, pass)
+	})
 	if err != nil {
-		log.Print(err)
+		return err
 	}
-	return string(hash)
+	_, err = s.sessionSvc.RevokeAll(ctx, security.KindManager, id)
+	return err
 }
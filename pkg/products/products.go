@@ -6,6 +6,7 @@ import (
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"log"
+	"strings"
 	"time"
 )
 
@@ -15,6 +16,26 @@ var ErrNotFound = errors.New("item not found")
 //ErrInternal ...
 var ErrInternal = errors.New("internal error")
 
+//ErrInvalidFilter ...
+var ErrInvalidFilter = errors.New("invalid product filter")
+
+//ErrInvalidProduct пустое название, неположительная цена или отрицательный остаток
+var ErrInvalidProduct = errors.New("invalid product")
+
+const (
+	defaultLimit = 20
+	maxLimit     = 100
+)
+
+//sortColumns поля, по которым можно сортировать список
+var sortColumns = map[string]string{
+	"id":      "id",
+	"name":    "name",
+	"price":   "price",
+	"qty":     "qty",
+	"created": "created",
+}
+
 //Service ..
 type ProductService struct {
 	//db *sql.DB
@@ -36,6 +57,172 @@ type Product struct {
 	Created time.Time `json:"created"`
 }
 
+//Filter условия списка товаров. Пустые поля не ограничивают выборку.
+//Sort - имя поля, с минусом впереди для сортировки по убыванию, например -price
+type Filter struct {
+	Query    string
+	Active   *bool
+	MinPrice *int
+	MaxPrice *int
+	MinQty   *int
+	MaxQty   *int
+	Sort     string
+	Limit    int
+	Offset   int
+}
+
+//Page страница списка и общее число товаров под фильтром
+type Page struct {
+	Items  []*Product `json:"items"`
+	Total  int64      `json:"total"`
+	Limit  int        `json:"limit"`
+	Offset int        `json:"offset"`
+}
+
+//orderBy возвращает ORDER BY для Sort, id в конце делает порядок страниц устойчивым
+func (f *Filter) orderBy() (string, error) {
+	if f.Sort == "" {
+		return "id", nil
+	}
+	direction := "ASC"
+	name := f.Sort
+	if strings.HasPrefix(name, "-") {
+		direction = "DESC"
+		name = name[1:]
+	}
+	column, ok := sortColumns[name]
+	if !ok {
+		return "", ErrInvalidFilter
+	}
+	if column == "id" {
+		return "id " + direction, nil
+	}
+	return column + " " + direction + ", id " + direction, nil
+}
+
+//List товары по фильтру постранично
+func (s *ProductService) List(ctx context.Context, filter *Filter) (*Page, error) {
+	orderBy, err := filter.orderBy()
+	if err != nil {
+		return nil, err
+	}
+	if filter.Limit <= 0 || filter.Limit > maxLimit {
+		filter.Limit = defaultLimit
+	}
+	if filter.Offset < 0 {
+		filter.Offset = 0
+	}
+	where := `
+WHERE ($1 = '' OR strpos(lower(name), lower($1)) > 0)
+  AND ($2::boolean IS NULL OR active = $2)
+  AND ($3::integer IS NULL OR price >= $3)
+  AND ($4::integer IS NULL OR price <= $4)
+  AND ($5::integer IS NULL OR qty >= $5)
+  AND ($6::integer IS NULL OR qty <= $6)`
+	args := []interface{}{strings.TrimSpace(filter.Query), filter.Active, filter.MinPrice, filter.MaxPrice,
+		filter.MinQty, filter.MaxQty}
+
+	page := &Page{Items: make([]*Product, 0), Limit: filter.Limit, Offset: filter.Offset}
+	err = s.pool.QueryRow(ctx, `SELECT count(*) FROM products`+where, args...).Scan(&page.Total)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	rows, err := s.pool.Query(ctx, `SELECT id, name, price, qty, active, created FROM products`+where+`
+ORDER BY `+orderBy+` LIMIT $7 OFFSET $8`, append(args, filter.Limit, filter.Offset)...)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item := &Product{}
+		err := rows.Scan(
+			&item.ID,
+			&item.Name,
+			&item.Price,
+			&item.Qty,
+			&item.Active,
+			&item.Created,
+		)
+		if err != nil {
+			log.Println(err)
+			return nil, ErrInternal
+		}
+		page.Items = append(page.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return page, nil
+}
+
+//Archive снимает товар с продажи. Товар остаётся в базе: на него ссылаются позиции прошлых продаж
+func (s *ProductService) Archive(ctx context.Context, id int64) (*Product, error) {
+	return s.setActive(ctx, id, false)
+}
+
+//Restore возвращает архивный товар в продажу. Изменение товара признак активности не трогает,
+//поэтому вернуть товар можно только этим явным действием
+func (s *ProductService) Restore(ctx context.Context, id int64) (*Product, error) {
+	return s.setActive(ctx, id, true)
+}
+
+func (s *ProductService) setActive(ctx context.Context, id int64, active bool) (*Product, error) {
+	item := &Product{}
+
+	err := s.pool.QueryRow(ctx, `
+UPDATE products SET active = $2 WHERE id=$1 RETURNING id, name, price, qty, active, created`, id, active).Scan(
+		&item.ID,
+		&item.Name,
+		&item.Price,
+		&item.Qty,
+		&item.Active,
+		&item.Created)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return item, nil
+}
+
+//Update записывает название, цену и остаток товара. Признак активности меняют только Archive и Restore.
+//Товар проверяется целиком, поэтому частичное изменение сначала накладывается на текущий товар
+func (s *ProductService) Update(ctx context.Context, product *Product) (*Product, error) {
+	product.Name = strings.TrimSpace(product.Name)
+	if product.Name == "" || product.Price <= 0 || product.Qty < 0 {
+		return nil, ErrInvalidProduct
+	}
+	item := &Product{}
+
+	err := s.pool.QueryRow(ctx, `
+UPDATE products SET name=$2, price=$3, qty=$4 WHERE id=$1 RETURNING id, name, price, qty, active, created`,
+		product.ID, product.Name, product.Price, product.Qty).Scan(
+		&item.ID,
+		&item.Name,
+		&item.Price,
+		&item.Qty,
+		&item.Active,
+		&item.Created)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return item, nil
+}
+
 func (s *ProductService) All(ctx context.Context) (cs []*Product, err error) {
 
 	sqlStatement := `select * from products`
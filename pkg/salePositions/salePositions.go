@@ -35,6 +35,10 @@ type SalePositions struct {
 	Price     int       `json:"price"`
 	Qty       int       `json:"qty"`
 	Created   time.Time `json:"created"`
+	//ListPrice цена товара в каталоге на момент продажи
+	ListPrice int `json:"listPrice"`
+	//PriceOverrideBy менеджер, изменивший цену позиции, если цена отличается от каталожной
+	PriceOverrideBy *int64 `json:"priceOverrideBy"`
 }
 
 func (s *SalePositionsService) All(ctx context.Context) (cs []*SalePositions, err error) {
@@ -57,6 +61,8 @@ func (s *SalePositionsService) All(ctx context.Context) (cs []*SalePositions, er
 			&item.Price,
 			&item.Qty,
 			&item.Created,
+			&item.ListPrice,
+			&item.PriceOverrideBy,
 		)
 		if err != nil {
 			log.Println(err)
@@ -78,7 +84,9 @@ SELECT * FROM sale_positions WHERE id=$1`, id).Scan(
 		&item.Name,
 		&item.Price,
 		&item.Qty,
-		&item.Created)
+		&item.Created,
+		&item.ListPrice,
+		&item.PriceOverrideBy)
 
 	if errors.Is(err, pgx.ErrNoRows) {
 		return nil, ErrNotFound
@@ -103,7 +111,9 @@ DELETE FROM sale_positions  WHERE id=$1 RETURNING *`, id).Scan(
 		&item.Name,
 		&item.Price,
 		&item.Qty,
-		&item.Created)
+		&item.Created,
+		&item.ListPrice,
+		&item.PriceOverrideBy)
 
 	if errors.Is(err, pgx.ErrNoRows) {
 		return nil, ErrNotFound
@@ -129,7 +139,9 @@ func (s *SalePositionsService) Save(ctx context.Context, customer *SalePositions
 			&item.Name,
 			&item.Price,
 			&item.Qty,
-			&item.Created)
+			&item.Created,
+			&item.ListPrice,
+			&item.PriceOverrideBy)
 	} else {
 		err = s.pool.QueryRow(ctx, `UPDATE sale_positions SET sale_id=$1, product_id=$2, name=$3, price=$4, qty=$5 where id=$6 RETURNING *`, customer.SaleId, customer.ProductId, customer.Name, customer.Price, customer.Qty, customer.ID).Scan(
 			&item.ID,
@@ -138,7 +150,9 @@ func (s *SalePositionsService) Save(ctx context.Context, customer *SalePositions
 			&item.Name,
 			&item.Price,
 			&item.Qty,
-			&item.Created)
+			&item.Created,
+			&item.ListPrice,
+			&item.PriceOverrideBy)
 	}
 
 	if errors.Is(err, pgx.ErrNoRows) {
@@ -0,0 +1,218 @@
+package sales
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/sidalsoft/crud/pkg/salePositions"
+	"github.com/sidalsoft/crud/pkg/security"
+	"log"
+	"sort"
+)
+
+//ErrProductNotFound товар из позиции не найден или снят с продажи
+var ErrProductNotFound = errors.New("product not found")
+
+//ErrInvalidPosition продажа без позиций или позиция с неположительным количеством
+var ErrInvalidPosition = errors.New("invalid position")
+
+//ErrCustomerNotFound покупатель продажи не найден или удалён
+var ErrCustomerNotFound = errors.New("customer not found")
+
+//ErrCustomerBlocked покупатель продажи заблокирован
+var ErrCustomerBlocked = errors.New("customer blocked")
+
+//InsufficientStockError возвращается, если остатка на складе не хватает для продажи
+type InsufficientStockError struct {
+	ProductIDs []int64
+}
+
+func (e *InsufficientStockError) Error() string {
+	return fmt.Sprintf("insufficient stock for products %v", e.ProductIDs)
+}
+
+//CheckoutPosition позиция продажи. Название и цена берутся из каталога,
+//PriceOverride задаётся только менеджером с правом менять цену
+type CheckoutPosition struct {
+	ProductId     int64
+	Qty           int
+	PriceOverride *int
+}
+
+type stockItem struct {
+	name  string
+	price int
+	qty   int
+}
+
+//checkCustomer проверяет, что покупатель существует, не удалён и не заблокирован. Строка покупателя
+//остаётся заблокированной на чтение до конца транзакции, чтобы его не удалили, пока оформляется продажа
+func checkCustomer(ctx context.Context, tx pgx.Tx, id int64) error {
+	var active bool
+	err := tx.QueryRow(ctx, `
+SELECT `+security.ActiveCondition("")+` FROM customers WHERE id = $1 AND deleted IS NULL FOR SHARE`, id).Scan(&active)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrCustomerNotFound
+	}
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	if !active {
+		return ErrCustomerBlocked
+	}
+	return nil
+}
+
+//Checkout оформляет продажу в одной транзакции: проверяет покупателя, блокирует строки товаров,
+//списывает остаток и сохраняет продажу вместе со всеми позициями.
+//Если цена позиции переопределена, менеджер записывается в price_override_by
+func (s *SalesService) Checkout(ctx context.Context, managerId int64, customerId *int64, positions []*CheckoutPosition) (*Sales, []*salePositions.SalePositions, error) {
+	required, ids, err := requiredQty(positions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		log.Println(err)
+		return nil, nil, ErrInternal
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			log.Println(err)
+		}
+	}()
+
+	if customerId != nil {
+		if err := checkCustomer(ctx, tx, *customerId); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// строки блокируются в порядке id, чтобы параллельные продажи не попадали в deadlock
+	rows, err := tx.Query(ctx, `
+SELECT id, name, price, qty FROM products WHERE id = ANY($1) AND active ORDER BY id FOR UPDATE`, ids)
+	if err != nil {
+		log.Println(err)
+		return nil, nil, ErrInternal
+	}
+	stock := make(map[int64]*stockItem)
+	for rows.Next() {
+		var id int64
+		item := &stockItem{}
+		if err := rows.Scan(&id, &item.name, &item.price, &item.qty); err != nil {
+			rows.Close()
+			log.Println(err)
+			return nil, nil, ErrInternal
+		}
+		stock[id] = item
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, nil, ErrInternal
+	}
+
+	if err := checkStock(ids, required, stock); err != nil {
+		return nil, nil, err
+	}
+
+	for _, id := range ids {
+		_, err := tx.Exec(ctx, `UPDATE products SET qty = qty - $2 WHERE id = $1`, id, required[id])
+		if err != nil {
+			log.Println(err)
+			return nil, nil, ErrInternal
+		}
+	}
+
+	sale := &Sales{}
+	err = tx.QueryRow(ctx, `INSERT INTO sales(manager_id, customer_id) values($1, $2) RETURNING *`, managerId, customerId).Scan(
+		&sale.ID,
+		&sale.ManagerId,
+		&sale.CustomerId,
+		&sale.Created)
+	if err != nil {
+		log.Println(err)
+		return nil, nil, ErrInternal
+	}
+
+	items := make([]*salePositions.SalePositions, 0, len(positions))
+	for _, position := range positions {
+		product := stock[position.ProductId]
+		price := product.price
+		var overrideBy *int64
+		if position.PriceOverride != nil {
+			price = *position.PriceOverride
+			overrideBy = &managerId
+		}
+		item := &salePositions.SalePositions{}
+		err := tx.QueryRow(ctx, `
+INSERT INTO sale_positions(sale_id, product_id, name, price, qty, list_price, price_override_by)
+values($1, $2, $3, $4, $5, $6, $7) RETURNING *`, sale.ID, position.ProductId, product.name, price, position.Qty, product.price, overrideBy).Scan(
+			&item.ID,
+			&item.SaleId,
+			&item.ProductId,
+			&item.Name,
+			&item.Price,
+			&item.Qty,
+			&item.Created,
+			&item.ListPrice,
+			&item.PriceOverrideBy)
+		if err != nil {
+			log.Println(err)
+			return nil, nil, ErrInternal
+		}
+		items = append(items, item)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		log.Println(err)
+		return nil, nil, ErrInternal
+	}
+	return sale, items, nil
+}
+
+//requiredQty проверяет позиции и суммирует количество по товарам.
+//id товаров возвращаются по возрастанию: в этом порядке блокируются строки
+func requiredQty(positions []*CheckoutPosition) (map[int64]int, []int64, error) {
+	if len(positions) == 0 {
+		return nil, nil, ErrInvalidPosition
+	}
+	required := make(map[int64]int)
+	for _, position := range positions {
+		if position.Qty <= 0 {
+			return nil, nil, ErrInvalidPosition
+		}
+		if position.PriceOverride != nil && *position.PriceOverride <= 0 {
+			return nil, nil, ErrInvalidPosition
+		}
+		required[position.ProductId] += position.Qty
+	}
+	ids := make([]int64, 0, len(required))
+	for id := range required {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return required, ids, nil
+}
+
+//checkStock проверяет, что все товары найдены и остатка хватает.
+//Недостающие товары перечисляются все сразу, чтобы клиент мог исправить продажу за один раз
+func checkStock(ids []int64, required map[int64]int, stock map[int64]*stockItem) error {
+	var insufficient []int64
+	for _, id := range ids {
+		item, ok := stock[id]
+		if !ok {
+			return fmt.Errorf("%w: %d", ErrProductNotFound, id)
+		}
+		if item.qty < required[id] {
+			insufficient = append(insufficient, id)
+		}
+	}
+	if len(insufficient) > 0 {
+		return &InsufficientStockError{ProductIDs: insufficient}
+	}
+	return nil
+}
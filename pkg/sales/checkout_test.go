@@ -0,0 +1,103 @@
+package sales
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRequiredQty(t *testing.T) {
+	price := 100
+	zero := 0
+	tests := []struct {
+		name      string
+		positions []*CheckoutPosition
+		required  map[int64]int
+		ids       []int64
+		err       error
+	}{
+		{name: "empty", err: ErrInvalidPosition},
+		{
+			name:      "zero qty",
+			positions: []*CheckoutPosition{{ProductId: 1, Qty: 0}},
+			err:       ErrInvalidPosition,
+		},
+		{
+			name:      "negative qty",
+			positions: []*CheckoutPosition{{ProductId: 1, Qty: -1}},
+			err:       ErrInvalidPosition,
+		},
+		{
+			name:      "zero price override",
+			positions: []*CheckoutPosition{{ProductId: 1, Qty: 1, PriceOverride: &zero}},
+			err:       ErrInvalidPosition,
+		},
+		{
+			name: "sums repeated products and sorts ids",
+			positions: []*CheckoutPosition{
+				{ProductId: 3, Qty: 1},
+				{ProductId: 1, Qty: 2, PriceOverride: &price},
+				{ProductId: 3, Qty: 4},
+			},
+			required: map[int64]int{1: 2, 3: 5},
+			ids:      []int64{1, 3},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			required, ids, err := requiredQty(test.positions)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("err = %v, want %v", err, test.err)
+			}
+			if !reflect.DeepEqual(required, test.required) {
+				t.Errorf("required = %v, want %v", required, test.required)
+			}
+			if !reflect.DeepEqual(ids, test.ids) {
+				t.Errorf("ids = %v, want %v", ids, test.ids)
+			}
+		})
+	}
+}
+
+func TestCheckStock(t *testing.T) {
+	stock := map[int64]*stockItem{
+		1: {name: "tea", price: 10, qty: 5},
+		2: {name: "milk", price: 20, qty: 1},
+		3: {name: "bread", price: 30, qty: 0},
+	}
+	tests := []struct {
+		name         string
+		required     map[int64]int
+		ids          []int64
+		notFound     bool
+		insufficient []int64
+	}{
+		{name: "enough", required: map[int64]int{1: 5, 2: 1}, ids: []int64{1, 2}},
+		{name: "missing product", required: map[int64]int{1: 1, 4: 1}, ids: []int64{1, 4}, notFound: true},
+		{
+			name:         "reports every short product",
+			required:     map[int64]int{1: 6, 2: 1, 3: 1},
+			ids:          []int64{1, 2, 3},
+			insufficient: []int64{1, 3},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkStock(test.ids, test.required, stock)
+			if errors.Is(err, ErrProductNotFound) != test.notFound {
+				t.Fatalf("err = %v, want not found %v", err, test.notFound)
+			}
+			var stockErr *InsufficientStockError
+			if errors.As(err, &stockErr) {
+				if !reflect.DeepEqual(stockErr.ProductIDs, test.insufficient) {
+					t.Errorf("insufficient = %v, want %v", stockErr.ProductIDs, test.insufficient)
+				}
+			} else if test.insufficient != nil {
+				t.Errorf("err = %v, want insufficient stock for %v", err, test.insufficient)
+			}
+			if !test.notFound && test.insufficient == nil && err != nil {
+				t.Errorf("err = %v, want nil", err)
+			}
+		})
+	}
+}
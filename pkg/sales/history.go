@@ -0,0 +1,74 @@
+package sales
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+//Purchase продажа, как её видит покупатель
+type Purchase struct {
+	ID        int64               `json:"id"`
+	Total     int                 `json:"total"`
+	Created   time.Time           `json:"created"`
+	Positions []*PurchasePosition `json:"positions"`
+}
+
+//PurchasePosition позиция покупки без служебных полей менеджера
+type PurchasePosition struct {
+	ProductId int64  `json:"productId"`
+	Name      string `json:"name"`
+	Price     int    `json:"price"`
+	Qty       int    `json:"qty"`
+}
+
+//ByCustomer история покупок покупателя, новые первыми
+func (s *SalesService) ByCustomer(ctx context.Context, customerId int64, limit int, offset int) ([]*Purchase, error) {
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	rows, err := s.pool.Query(ctx, `
+SELECT s.id, s.created, sp.product_id, sp.name, sp.price, sp.qty
+FROM (SELECT id, created FROM sales WHERE customer_id = $1 ORDER BY created DESC, id DESC LIMIT $2 OFFSET $3) s
+JOIN sale_positions sp ON sp.sale_id = s.id
+ORDER BY s.created DESC, s.id DESC, sp.id`, customerId, limit, offset)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	defer rows.Close()
+
+	items := make([]*Purchase, 0)
+	var current *Purchase
+	for rows.Next() {
+		var id int64
+		var created time.Time
+		position := &PurchasePosition{}
+		err := rows.Scan(
+			&id,
+			&created,
+			&position.ProductId,
+			&position.Name,
+			&position.Price,
+			&position.Qty,
+		)
+		if err != nil {
+			log.Println(err)
+			return nil, ErrInternal
+		}
+		if current == nil || current.ID != id {
+			current = &Purchase{ID: id, Created: created, Positions: make([]*PurchasePosition, 0)}
+			items = append(items, current)
+		}
+		current.Positions = append(current.Positions, position)
+		current.Total += position.Price * position.Qty
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return items, nil
+}
@@ -0,0 +1,225 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoSuchAPIKey     = errors.New("no such api key")
+	ErrInvalidAPIKey    = errors.New("invalid api key")
+	ErrIPNotAllowed     = errors.New("ip address not allowed for this api key")
+	ErrInvalidAllowedIP = errors.New("invalid allowed ip")
+)
+
+//apiKeyPrefix отличает API-ключи от токенов в логах и при случайной утечке
+const apiKeyPrefix = "ck_"
+
+//APIKey ключ машинного клиента. Запросы с ключом выполняются от имени владельца-менеджера,
+//но только в пределах Scopes. Сам ключ показывается один раз при создании, в базе хранится его отпечаток
+type APIKey struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	OwnerID    int64      `json:"ownerId"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	AllowedIPs []string   `json:"allowedIps"`
+	Expire     *time.Time `json:"expire"`
+	LastUsed   *time.Time `json:"lastUsed"`
+	LastIP     string     `json:"lastIp"`
+	Revoked    *time.Time `json:"revoked"`
+	Created    time.Time  `json:"created"`
+	Key        string     `json:"key,omitempty"`
+}
+
+//APIKeyService выпускает и проверяет API-ключи
+type APIKeyService struct {
+	pool       *pgxpool.Pool
+	sessionSvc *SessionService
+}
+
+//NewAPIKeyService ..
+func NewAPIKeyService(pool *pgxpool.Pool, sessionSvc *SessionService) *APIKeyService {
+	return &APIKeyService{pool: pool, sessionSvc: sessionSvc}
+}
+
+const apiKeyColumns = `id, name, manager_id, prefix, scopes, allowed_ips, expire, last_used, last_ip, revoked, created`
+
+func scanAPIKey(row pgx.Row) (*APIKey, error) {
+	item := &APIKey{}
+	err := row.Scan(
+		&item.ID,
+		&item.Name,
+		&item.OwnerID,
+		&item.Prefix,
+		&item.Scopes,
+		&item.AllowedIPs,
+		&item.Expire,
+		&item.LastUsed,
+		&item.LastIP,
+		&item.Revoked,
+		&item.Created,
+	)
+	return item, err
+}
+
+//Create выпускает ключ. Права ключа - пересечение Scopes с текущими правами владельца
+func (s *APIKeyService) Create(ctx context.Context, key *APIKey) (*APIKey, error) {
+	name := strings.TrimSpace(key.Name)
+	scopes := unique(key.Scopes)
+	if name == "" || len(scopes) == 0 {
+		return nil, ErrInvalidAPIKey
+	}
+	if key.Expire != nil && !key.Expire.After(time.Now()) {
+		return nil, ErrInvalidAPIKey
+	}
+	allowedIPs := unique(key.AllowedIPs)
+	for _, value := range allowedIPs {
+		if _, _, err := net.ParseCIDR(value); err != nil && net.ParseIP(value) == nil {
+			return nil, ErrInvalidAllowedIP
+		}
+	}
+
+	var count int
+	err := s.pool.QueryRow(ctx, `SELECT count(*) FROM permissions WHERE name = ANY($1)`, scopes).Scan(&count)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	if count != len(scopes) {
+		return nil, ErrUnknownPermission
+	}
+
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+	secret = apiKeyPrefix + secret
+	item, err := scanAPIKey(s.pool.QueryRow(ctx, `
+INSERT INTO api_keys(name, manager_id, prefix, key_hash, scopes, allowed_ips, expire)
+SELECT $1, id, $3, $4, $5, $6, $7 FROM managers WHERE id = $2 AND `+ActiveCondition("")+`
+RETURNING `+apiKeyColumns,
+		name, key.OwnerID, secret[:len(apiKeyPrefix)+8], s.sessionSvc.Digest(secret), scopes, allowedIPs, key.Expire))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNoSuchUser
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	item.Key = secret
+	return item, nil
+}
+
+//All все ключи, сначала новые
+func (s *APIKeyService) All(ctx context.Context) ([]*APIKey, error) {
+	rows, err := s.pool.Query(ctx, `SELECT `+apiKeyColumns+` FROM api_keys ORDER BY created DESC, id DESC`)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	defer rows.Close()
+
+	items := make([]*APIKey, 0)
+	for rows.Next() {
+		item, err := scanAPIKey(rows)
+		if err != nil {
+			log.Println(err)
+			return nil, ErrInternal
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return items, nil
+}
+
+//Revoke отзывает ключ
+func (s *APIKeyService) Revoke(ctx context.Context, id int64) (*APIKey, error) {
+	item, err := scanAPIKey(s.pool.QueryRow(ctx, `
+UPDATE api_keys SET revoked = COALESCE(revoked, CURRENT_TIMESTAMP) WHERE id = $1
+RETURNING `+apiKeyColumns, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNoSuchAPIKey
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return item, nil
+}
+
+//Authenticate находит действующий ключ, проверяет IP клиента и отмечает использование
+func (s *APIKeyService) Authenticate(ctx context.Context, secret string, client *Client) (*APIKey, error) {
+	if !strings.HasPrefix(secret, apiKeyPrefix) {
+		return nil, ErrNoSuchToken
+	}
+	var active bool
+	item := &APIKey{}
+	err := s.pool.QueryRow(ctx, `
+SELECT k.id, k.name, k.manager_id, k.scopes, k.allowed_ips, k.expire, k.revoked, `+ActiveCondition("m.")+`
+FROM api_keys k JOIN managers m ON m.id = k.manager_id
+WHERE k.key_hash = $1`, s.sessionSvc.Digest(secret)).Scan(
+		&item.ID,
+		&item.Name,
+		&item.OwnerID,
+		&item.Scopes,
+		&item.AllowedIPs,
+		&item.Expire,
+		&item.Revoked,
+		&active)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNoSuchToken
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	if item.Revoked != nil || !active {
+		return nil, ErrTokenRevoked
+	}
+	if item.Expire != nil && !item.Expire.After(time.Now()) {
+		return nil, ErrTokenExpired
+	}
+	ip := ""
+	if client != nil {
+		ip = client.IP
+	}
+	if len(item.AllowedIPs) != 0 && !ipAllowed(ip, item.AllowedIPs) {
+		return nil, ErrIPNotAllowed
+	}
+
+	_, err = s.pool.Exec(ctx, `UPDATE api_keys SET last_used = CURRENT_TIMESTAMP, last_ip = $2 WHERE id = $1`, item.ID, ip)
+	if err != nil {
+		log.Println(err)
+	}
+	return item, nil
+}
+
+//ipAllowed проверяет IP по списку адресов и подсетей
+func ipAllowed(value string, allowed []string) bool {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return false
+	}
+	for _, item := range allowed {
+		if _, network, err := net.ParseCIDR(item); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if allowedIP := net.ParseIP(item); allowedIP != nil && allowedIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,310 @@
+package security
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Действия, которые попадают в журнал аудита
+const (
+	AuditLogin             = "login"
+	AuditLoginMFA          = "login.mfa"
+	AuditTokenRefresh      = "token.refresh"
+	AuditPasswordChange    = "password.change"
+	AuditPasswordReset     = "password.reset"
+	AuditSessionsRevoke    = "sessions.revoke"
+	AuditManagerRegister   = "manager.register"
+	AuditManagerBootstrap  = "manager.bootstrap"
+	AuditManagerUpdate     = "manager.update"
+	AuditManagerRoles      = "manager.roles"
+	AuditRoleSave          = "role.save"
+	AuditRoleDelete        = "role.delete"
+	AuditCustomerCreate    = "customer.create"
+	AuditCustomerUpdate    = "customer.update"
+	AuditCustomerDelete    = "customer.delete"
+	AuditCustomerBlock     = "customer.block"
+	AuditCustomerUnblock   = "customer.unblock"
+	AuditManagerBlock      = "manager.block"
+	AuditManagerUnblock    = "manager.unblock"
+	AuditAPIKeyCreate      = "api_key.create"
+	AuditAPIKeyRevoke      = "api_key.revoke"
+	AuditCertificateBind   = "certificate.bind"
+	AuditCertificateRevoke = "certificate.revoke"
+)
+
+//Виды объектов аудита, кроме KindManager и KindCustomer
+const (
+	AuditTargetRole        = "role"
+	AuditTargetAPIKey      = "api_key"
+	AuditTargetCertificate = "certificate"
+)
+
+//Результат действия
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+const (
+	//auditTimeLayout время в хэше, с той же точностью, что хранит база
+	auditTimeLayout = "2006-01-02T15:04:05.000000"
+	//auditChainLock ключ advisory-блокировки, под которой добавляются записи
+	auditChainLock    = 7402018
+	defaultAuditLimit = 50
+	maxAuditLimit     = 500
+	auditVerifyBatch  = 1000
+)
+
+//AuditEvent запись журнала. Hash считается от PrevHash и полей записи,
+//поэтому изменение или удаление прошлой записи разрывает цепочку
+type AuditEvent struct {
+	ID         int64     `json:"id"`
+	ActorKind  string    `json:"actorKind"`
+	ActorID    *int64    `json:"actorId"`
+	Action     string    `json:"action"`
+	TargetKind string    `json:"targetKind"`
+	TargetID   string    `json:"targetId"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"userAgent"`
+	Outcome    string    `json:"outcome"`
+	Details    string    `json:"details"`
+	Created    time.Time `json:"created"`
+	PrevHash   string    `json:"prevHash"`
+	Hash       string    `json:"hash"`
+}
+
+//AuditFilter ...
+type AuditFilter struct {
+	ActorKind  string
+	ActorID    int64
+	Action     string
+	TargetKind string
+	TargetID   string
+	Outcome    string
+	From       *time.Time
+	To         *time.Time
+	Limit      int
+	Offset     int
+}
+
+//AuditVerification результат проверки цепочки. BrokenID - первая запись, на которой цепочка не сходится
+type AuditVerification struct {
+	Valid    bool  `json:"valid"`
+	Checked  int64 `json:"checked"`
+	BrokenID int64 `json:"brokenId,omitempty"`
+}
+
+//AuditService журнал событий безопасности. Записи только добавляются, изменение и удаление запрещены в базе
+type AuditService struct {
+	pool *pgxpool.Pool
+}
+
+//NewAuditService ..
+func NewAuditService(pool *pgxpool.Pool) *AuditService {
+	return &AuditService{pool: pool}
+}
+
+//digest хэш записи вместе с хэшем предыдущей
+func (e *AuditEvent) digest() string {
+	actorID := ""
+	if e.ActorID != nil {
+		actorID = strconv.FormatInt(*e.ActorID, 10)
+	}
+	//каждое поле предваряется длиной, чтобы нельзя было перенести символы из одного поля в соседнее
+	fields := []string{
+		e.PrevHash,
+		e.ActorKind,
+		actorID,
+		e.Action,
+		e.TargetKind,
+		e.TargetID,
+		e.IP,
+		e.UserAgent,
+		e.Outcome,
+		e.Details,
+		e.Created.UTC().Format(auditTimeLayout),
+	}
+	var data strings.Builder
+	for _, field := range fields {
+		data.WriteString(strconv.Itoa(len(field)))
+		data.WriteString(":")
+		data.WriteString(field)
+	}
+	sum := sha256.Sum256([]byte(data.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+//follows проверяет, что запись продолжает цепочку после записи с хэшем prevHash и не изменена
+func (e *AuditEvent) follows(prevHash string) bool {
+	return e.PrevHash == prevHash && e.digest() == e.Hash
+}
+
+//Record добавляет событие в конец цепочки. Ошибка записи журнала только логируется,
+//чтобы сбой аудита не ломал сам запрос
+func (s *AuditService) Record(ctx context.Context, event *AuditEvent) {
+	if event.Outcome == "" {
+		event.Outcome = AuditSuccess
+	}
+	//в базе время хранится с точностью до микросекунд, хэш должен сходиться после чтения
+	event.Created = time.Now().UTC().Truncate(time.Microsecond)
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && err != pgx.ErrTxClosed {
+			log.Println(err)
+		}
+	}()
+
+	//записи добавляются строго по очереди, иначе две записи получат один PrevHash
+	_, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, auditChainLock)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	err = tx.QueryRow(ctx, `SELECT hash FROM audit_events ORDER BY id DESC LIMIT 1`).Scan(&event.PrevHash)
+	if err == pgx.ErrNoRows {
+		event.PrevHash = ""
+		err = nil
+	}
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	event.Hash = event.digest()
+	err = tx.QueryRow(ctx, `
+INSERT INTO audit_events(actor_kind, actor_id, action, target_kind, target_id, ip, user_agent, outcome, details,
+                         created, prev_hash, hash)
+VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id`,
+		event.ActorKind, event.ActorID, event.Action, event.TargetKind, event.TargetID, event.IP, event.UserAgent,
+		event.Outcome, event.Details, event.Created, event.PrevHash, event.Hash).Scan(&event.ID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Println(err)
+	}
+}
+
+const auditColumns = `id, actor_kind, actor_id, action, target_kind, target_id, ip, user_agent, outcome, details,
+       created, prev_hash, hash`
+
+func scanAuditEvent(row pgx.Row) (*AuditEvent, error) {
+	item := &AuditEvent{}
+	err := row.Scan(
+		&item.ID,
+		&item.ActorKind,
+		&item.ActorID,
+		&item.Action,
+		&item.TargetKind,
+		&item.TargetID,
+		&item.IP,
+		&item.UserAgent,
+		&item.Outcome,
+		&item.Details,
+		&item.Created,
+		&item.PrevHash,
+		&item.Hash,
+	)
+	return item, err
+}
+
+//Events записи журнала по фильтру, сначала новые
+func (s *AuditService) Events(ctx context.Context, filter *AuditFilter) ([]*AuditEvent, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = defaultAuditLimit
+	}
+	if filter.Limit > maxAuditLimit {
+		filter.Limit = maxAuditLimit
+	}
+	if filter.Offset < 0 {
+		filter.Offset = 0
+	}
+	rows, err := s.pool.Query(ctx, `
+SELECT `+auditColumns+` FROM audit_events
+WHERE ($1 = '' OR actor_kind = $1)
+  AND ($2 = 0 OR actor_id = $2)
+  AND ($3 = '' OR action = $3)
+  AND ($4 = '' OR target_kind = $4)
+  AND ($5 = '' OR target_id = $5)
+  AND ($6 = '' OR outcome = $6)
+  AND ($7::timestamp IS NULL OR created >= $7)
+  AND ($8::timestamp IS NULL OR created < $8)
+ORDER BY id DESC LIMIT $9 OFFSET $10`,
+		filter.ActorKind, filter.ActorID, filter.Action, filter.TargetKind, filter.TargetID, filter.Outcome,
+		filter.From, filter.To, filter.Limit, filter.Offset)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	defer rows.Close()
+
+	items := make([]*AuditEvent, 0)
+	for rows.Next() {
+		item, err := scanAuditEvent(rows)
+		if err != nil {
+			log.Println(err)
+			return nil, ErrInternal
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return items, nil
+}
+
+//Verify проходит всю цепочку от первой записи и пересчитывает хэши
+func (s *AuditService) Verify(ctx context.Context) (*AuditVerification, error) {
+	result := &AuditVerification{Valid: true}
+	prevHash := ""
+	var lastID int64
+	for {
+		rows, err := s.pool.Query(ctx, `SELECT `+auditColumns+` FROM audit_events WHERE id > $1 ORDER BY id LIMIT $2`,
+			lastID, auditVerifyBatch)
+		if err != nil {
+			log.Println(err)
+			return nil, ErrInternal
+		}
+		count := 0
+		for rows.Next() {
+			item, err := scanAuditEvent(rows)
+			if err != nil {
+				rows.Close()
+				log.Println(err)
+				return nil, ErrInternal
+			}
+			count++
+			lastID = item.ID
+			result.Checked++
+			if !item.follows(prevHash) {
+				rows.Close()
+				result.Valid = false
+				result.BrokenID = item.ID
+				return result, nil
+			}
+			prevHash = item.Hash
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			log.Println(err)
+			return nil, ErrInternal
+		}
+		if count < auditVerifyBatch {
+			return result, nil
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package security
+
+import (
+	"testing"
+	"time"
+)
+
+//auditChain связывает записи в цепочку так же, как Record
+func auditChain(events ...*AuditEvent) []*AuditEvent {
+	prevHash := ""
+	for _, event := range events {
+		event.PrevHash = prevHash
+		event.Hash = event.digest()
+		prevHash = event.Hash
+	}
+	return events
+}
+
+func testAuditEvents() []*AuditEvent {
+	created := time.Date(2026, 10, 18, 12, 0, 0, 123456000, time.UTC)
+	managerID := int64(7)
+	return auditChain(
+		&AuditEvent{ActorKind: KindManager, ActorID: &managerID, Action: AuditLogin, TargetKind: KindManager,
+			TargetID: "+992000000001", IP: "10.0.0.1", UserAgent: "curl", Outcome: AuditSuccess, Created: created},
+		&AuditEvent{ActorKind: KindManager, ActorID: &managerID, Action: AuditRoleSave, TargetKind: AuditTargetRole,
+			TargetID: "ADMIN", Outcome: AuditFailure, Details: "forbidden", Created: created.Add(time.Second)},
+		&AuditEvent{Action: AuditLogin, TargetKind: KindCustomer, TargetID: "+992000000002",
+			Outcome: AuditSuccess, Created: created.Add(2 * time.Second)},
+	)
+}
+
+func TestAuditChainFollows(t *testing.T) {
+	otherID := int64(8)
+	tests := []struct {
+		name   string
+		change func(events []*AuditEvent)
+		broken int
+	}{
+		{name: "intact", change: func([]*AuditEvent) {}, broken: -1},
+		{name: "changed actor", change: func(e []*AuditEvent) { e[1].ActorID = &otherID }, broken: 1},
+		{name: "removed actor", change: func(e []*AuditEvent) { e[0].ActorID = nil }, broken: 0},
+		{name: "changed action", change: func(e []*AuditEvent) { e[1].Action = AuditRoleDelete }, broken: 1},
+		{name: "changed outcome", change: func(e []*AuditEvent) { e[1].Outcome = AuditSuccess }, broken: 1},
+		{name: "changed details", change: func(e []*AuditEvent) { e[1].Details = "" }, broken: 1},
+		{name: "changed ip", change: func(e []*AuditEvent) { e[0].IP = "10.0.0.2" }, broken: 0},
+		{name: "changed time", change: func(e []*AuditEvent) { e[2].Created = e[2].Created.Add(time.Microsecond) }, broken: 2},
+		{name: "rehashed record breaks the next link", change: func(e []*AuditEvent) {
+			e[1].Details = ""
+			e[1].Hash = e[1].digest()
+		}, broken: 2},
+		{name: "deleted record", change: func(e []*AuditEvent) { e[1] = e[2] }, broken: 1},
+		{name: "swapped records", change: func(e []*AuditEvent) { e[0], e[1] = e[1], e[0] }, broken: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events := testAuditEvents()
+			test.change(events)
+			broken := -1
+			prevHash := ""
+			for i, event := range events {
+				if !event.follows(prevHash) {
+					broken = i
+					break
+				}
+				prevHash = event.Hash
+			}
+			if broken != test.broken {
+				t.Errorf("chain breaks at %d, want %d", broken, test.broken)
+			}
+		})
+	}
+}
+
+func TestAuditDigest(t *testing.T) {
+	created := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	zero := int64(0)
+	tests := []struct {
+		name  string
+		left  *AuditEvent
+		right *AuditEvent
+		same  bool
+	}{
+		{
+			name:  "same moment in another zone",
+			left:  &AuditEvent{Action: AuditLogin, Created: created},
+			right: &AuditEvent{Action: AuditLogin, Created: created.In(time.FixedZone("UTC+5", 5*60*60))},
+			same:  true,
+		},
+		{
+			name:  "characters moved between fields",
+			left:  &AuditEvent{TargetKind: "ab", TargetID: "c", Created: created},
+			right: &AuditEvent{TargetKind: "a", TargetID: "bc", Created: created},
+		},
+		{
+			name:  "no actor differs from actor 0",
+			left:  &AuditEvent{Created: created},
+			right: &AuditEvent{ActorID: &zero, Created: created},
+		},
+		{
+			name:  "previous hash is part of the digest",
+			left:  &AuditEvent{Created: created},
+			right: &AuditEvent{PrevHash: "00", Created: created},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if same := test.left.digest() == test.right.digest(); same != test.same {
+				t.Errorf("same digest = %v, want %v", same, test.same)
+			}
+		})
+	}
+}
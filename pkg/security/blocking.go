@@ -0,0 +1,193 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"log"
+	"strings"
+	"time"
+)
+
+//ErrInvalidBlock дата окончания блокировки уже прошла
+var ErrInvalidBlock = errors.New("block end must be in the future")
+
+//BlockedError учётная запись заблокирована. Until не задан для бессрочной блокировки
+type BlockedError struct {
+	Reason string
+	Until  *time.Time
+}
+
+func (e *BlockedError) Error() string {
+	return "account blocked"
+}
+
+//AccountBlock состояние блокировки учётной записи
+type AccountBlock struct {
+	ID     int64      `json:"id"`
+	Kind   string     `json:"kind"`
+	Active bool       `json:"active"`
+	Reason string     `json:"reason"`
+	Until  *time.Time `json:"until"`
+}
+
+func scanAccountBlock(row pgx.Row, kind string) (*AccountBlock, error) {
+	item := &AccountBlock{Kind: kind}
+	err := row.Scan(&item.ID, &item.Active, &item.Reason, &item.Until)
+	return item, err
+}
+
+//accountTables таблицы учётных записей для каждого вида пользователей
+var accountTables = map[string]string{
+	KindCustomer: "customers",
+	KindManager:  "managers",
+}
+
+//accountScopes отсекает учётные записи, удалённые без удаления строки: их нельзя ни заблокировать, ни разблокировать
+var accountScopes = map[string]string{
+	KindCustomer: " AND deleted IS NULL",
+}
+
+//ActiveCondition условие SQL для действующей учётной записи: не заблокирована или срок блокировки истёк.
+//prefix - алиас таблицы с точкой или пустая строка
+func ActiveCondition(prefix string) string {
+	return `(` + prefix + `active OR COALESCE(` + prefix + `blocked_until <= CURRENT_TIMESTAMP, FALSE))`
+}
+
+//BlockService блокирует покупателей и менеджеров. Блокировка отзывает все сессии,
+//а временная блокировка снимается сама по истечении срока
+type BlockService struct {
+	pool       *pgxpool.Pool
+	sessionSvc *SessionService
+}
+
+//NewBlockService ..
+func NewBlockService(pool *pgxpool.Pool, sessionSvc *SessionService) *BlockService {
+	return &BlockService{pool: pool, sessionSvc: sessionSvc}
+}
+
+//Block блокирует пользователя и завершает все его сессии одной транзакцией. until == nil - бессрочно
+func (s *BlockService) Block(ctx context.Context, kind string, id int64, reason string, until *time.Time) (*AccountBlock, error) {
+	table, ok := accountTables[kind]
+	if !ok {
+		return nil, ErrUnknownKind
+	}
+	if until != nil && !until.After(time.Now()) {
+		return nil, ErrInvalidBlock
+	}
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			log.Println(err)
+		}
+	}()
+
+	item, err := scanAccountBlock(tx.QueryRow(ctx, `
+UPDATE `+table+` SET active = FALSE, blocked_reason = $2, blocked_until = $3 WHERE id = $1`+accountScopes[kind]+`
+RETURNING id, active, blocked_reason, blocked_until`, id, strings.TrimSpace(reason), until), kind)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNoSuchUser
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	if _, err = s.sessionSvc.RevokeAllTx(ctx, tx, kind, id); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return item, nil
+}
+
+//Unblock снимает блокировку
+func (s *BlockService) Unblock(ctx context.Context, kind string, id int64) (*AccountBlock, error) {
+	table, ok := accountTables[kind]
+	if !ok {
+		return nil, ErrUnknownKind
+	}
+	item, err := scanAccountBlock(s.pool.QueryRow(ctx, `
+UPDATE `+table+` SET active = TRUE, blocked_reason = '', blocked_until = NULL WHERE id = $1`+accountScopes[kind]+`
+RETURNING id, active, blocked_reason, blocked_until`, id), kind)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNoSuchUser
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return item, nil
+}
+
+//Check возвращает *BlockedError, если пользователь заблокирован.
+//Истёкшая временная блокировка снимается прямо здесь, не дожидаясь ReactivateExpired
+func (s *BlockService) Check(ctx context.Context, kind string, id int64) error {
+	table, ok := accountTables[kind]
+	if !ok {
+		return ErrUnknownKind
+	}
+	var active bool
+	blocked := &BlockedError{}
+	err := s.pool.QueryRow(ctx, `SELECT active, blocked_reason, blocked_until FROM `+table+` WHERE id = $1`+accountScopes[kind], id).
+		Scan(&active, &blocked.Reason, &blocked.Until)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNoSuchUser
+	}
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	if active {
+		return nil
+	}
+	if blocked.Until != nil && !blocked.Until.After(time.Now()) {
+		_, err = s.pool.Exec(ctx, `
+UPDATE `+table+` SET active = TRUE, blocked_reason = '', blocked_until = NULL
+WHERE id = $1 AND NOT active AND blocked_until <= CURRENT_TIMESTAMP`, id)
+		if err != nil {
+			log.Println(err)
+			return ErrInternal
+		}
+		return nil
+	}
+	return blocked
+}
+
+//ReactivateExpired снимает все истёкшие временные блокировки
+func (s *BlockService) ReactivateExpired(ctx context.Context) (int64, error) {
+	var total int64
+	for _, table := range accountTables {
+		tag, err := s.pool.Exec(ctx, `
+UPDATE `+table+` SET active = TRUE, blocked_reason = '', blocked_until = NULL
+WHERE NOT active AND blocked_until <= CURRENT_TIMESTAMP`)
+		if err != nil {
+			log.Println(err)
+			return total, ErrInternal
+		}
+		total += tag.RowsAffected()
+	}
+	return total, nil
+}
+
+//Run периодически вызывает ReactivateExpired, пока не отменён ctx
+func (s *BlockService) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if count, err := s.ReactivateExpired(ctx); err == nil && count > 0 {
+				log.Printf("reactivated %d accounts after temporary block", count)
+			}
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package security
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"sync"
+)
+
+//BootstrapToken одноразовый токен для создания первого администратора через API.
+//Живёт только в памяти процесса и печатается в лог при старте, если в базе нет менеджеров
+type BootstrapToken struct {
+	mu     sync.Mutex
+	digest [sha256.Size]byte
+	used   bool
+}
+
+//NewBootstrapToken возвращает токен и его значение для вывода в лог
+func NewBootstrapToken() (*BootstrapToken, string, error) {
+	value, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+	return &BootstrapToken{digest: sha256.Sum256([]byte(value))}, value, nil
+}
+
+//Valid проверяет токен. После Invalidate, как и у nil, любой токен недействителен
+func (t *BootstrapToken) Valid(value string) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	digest := sha256.Sum256([]byte(value))
+	return !t.used && subtle.ConstantTimeCompare(digest[:], t.digest[:]) == 1
+}
+
+//Invalidate гасит токен после создания администратора
+func (t *BootstrapToken) Invalidate() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.used = true
+}
@@ -0,0 +1,191 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"log"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoSuchCertificate      = errors.New("no such client certificate")
+	ErrInvalidCertificate     = errors.New("invalid client certificate binding")
+	ErrCertificateSubjectUsed = errors.New("client certificate subject already bound")
+)
+
+//ClientCertificate привязка субъекта (CommonName) клиентского сертификата, выпущенного нашим CA,
+//к менеджеру или к API-ключу. Задаётся ровно одно из ManagerID и APIKeyID
+type ClientCertificate struct {
+	ID        int64      `json:"id"`
+	Subject   string     `json:"subject"`
+	ManagerID *int64     `json:"managerId"`
+	APIKeyID  *int64     `json:"apiKeyId"`
+	LastUsed  *time.Time `json:"lastUsed"`
+	Revoked   *time.Time `json:"revoked"`
+	Created   time.Time  `json:"created"`
+}
+
+//CertificateIdentity пользователь, от имени которого работает сертификат.
+//Для привязки к API-ключу права ограничены Scopes ключа
+type CertificateIdentity struct {
+	CertificateID int64
+	ManagerID     int64
+	APIKeyID      int64
+	Scopes        []string
+}
+
+//CertificateService сопоставляет проверенные клиентские сертификаты пользователям
+type CertificateService struct {
+	pool *pgxpool.Pool
+}
+
+//NewCertificateService ..
+func NewCertificateService(pool *pgxpool.Pool) *CertificateService {
+	return &CertificateService{pool: pool}
+}
+
+const certificateColumns = `id, subject, manager_id, api_key_id, last_used, revoked, created`
+
+func scanCertificate(row pgx.Row) (*ClientCertificate, error) {
+	item := &ClientCertificate{}
+	err := row.Scan(
+		&item.ID,
+		&item.Subject,
+		&item.ManagerID,
+		&item.APIKeyID,
+		&item.LastUsed,
+		&item.Revoked,
+		&item.Created,
+	)
+	return item, err
+}
+
+//Bind привязывает субъект сертификата к менеджеру или API-ключу
+func (s *CertificateService) Bind(ctx context.Context, item *ClientCertificate) (*ClientCertificate, error) {
+	subject := strings.TrimSpace(item.Subject)
+	if subject == "" || (item.ManagerID == nil) == (item.APIKeyID == nil) {
+		return nil, ErrInvalidCertificate
+	}
+
+	var exists bool
+	var err error
+	if item.ManagerID != nil {
+		err = s.pool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM managers WHERE id = $1)`, *item.ManagerID).Scan(&exists)
+	} else {
+		err = s.pool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM api_keys WHERE id = $1 AND revoked IS NULL)`, *item.APIKeyID).Scan(&exists)
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	if !exists {
+		return nil, ErrInvalidCertificate
+	}
+
+	result, err := scanCertificate(s.pool.QueryRow(ctx, `
+INSERT INTO client_certificates(subject, manager_id, api_key_id) VALUES($1, $2, $3)
+ON CONFLICT (subject) WHERE revoked IS NULL DO NOTHING
+RETURNING `+certificateColumns, subject, item.ManagerID, item.APIKeyID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrCertificateSubjectUsed
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return result, nil
+}
+
+//All все привязки, сначала новые
+func (s *CertificateService) All(ctx context.Context) ([]*ClientCertificate, error) {
+	rows, err := s.pool.Query(ctx, `SELECT `+certificateColumns+` FROM client_certificates ORDER BY created DESC, id DESC`)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	defer rows.Close()
+
+	items := make([]*ClientCertificate, 0)
+	for rows.Next() {
+		item, err := scanCertificate(rows)
+		if err != nil {
+			log.Println(err)
+			return nil, ErrInternal
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return items, nil
+}
+
+//Revoke отзывает привязку. Сам сертификат остаётся действительным для TLS, но больше никого не аутентифицирует
+func (s *CertificateService) Revoke(ctx context.Context, id int64) (*ClientCertificate, error) {
+	item, err := scanCertificate(s.pool.QueryRow(ctx, `
+UPDATE client_certificates SET revoked = COALESCE(revoked, CURRENT_TIMESTAMP) WHERE id = $1
+RETURNING `+certificateColumns, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNoSuchCertificate
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return item, nil
+}
+
+//Authenticate находит пользователя по субъекту сертификата, уже проверенного TLS.
+//Без действующей привязки возвращается ErrNoSuchToken. Для сертификата, привязанного к API-ключу,
+//IP клиента проверяется по списку адресов ключа, как и при входе по самому ключу
+func (s *CertificateService) Authenticate(ctx context.Context, subject string, client *Client) (*CertificateIdentity, error) {
+	identity := &CertificateIdentity{}
+	var managerID, apiKeyID *int64
+	var scopes, allowedIPs []string
+	var active bool
+	err := s.pool.QueryRow(ctx, `
+SELECT c.id, COALESCE(c.manager_id, k.manager_id), c.api_key_id, k.scopes, k.allowed_ips,
+       `+ActiveCondition("m.")+` AND (k.id IS NULL OR (k.revoked IS NULL AND (k.expire IS NULL OR k.expire > CURRENT_TIMESTAMP)))
+FROM client_certificates c
+LEFT JOIN api_keys k ON k.id = c.api_key_id
+JOIN managers m ON m.id = COALESCE(c.manager_id, k.manager_id)
+WHERE c.subject = $1 AND c.revoked IS NULL`, subject).Scan(
+		&identity.CertificateID,
+		&managerID,
+		&apiKeyID,
+		&scopes,
+		&allowedIPs,
+		&active)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNoSuchToken
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	if !active || managerID == nil {
+		return nil, ErrTokenRevoked
+	}
+	ip := ""
+	if client != nil {
+		ip = client.IP
+	}
+	if len(allowedIPs) != 0 && !ipAllowed(ip, allowedIPs) {
+		return nil, ErrIPNotAllowed
+	}
+	identity.ManagerID = *managerID
+	if apiKeyID != nil {
+		identity.APIKeyID = *apiKeyID
+		identity.Scopes = scopes
+	}
+
+	_, err = s.pool.Exec(ctx, `UPDATE client_certificates SET last_used = CURRENT_TIMESTAMP WHERE id = $1`, identity.CertificateID)
+	if err != nil {
+		log.Println(err)
+	}
+	return identity, nil
+}
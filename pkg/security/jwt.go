@@ -0,0 +1,369 @@
+package security
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ErrInvalidToken подпись, формат или ключ JWT не прошли проверку
+var ErrInvalidToken = errors.New("invalid token")
+
+//JWTConfig настройки подписи access-токенов.
+//KeysDir содержит PEM-файлы <kid>.key (закрытые ключи) и <kid>.pub (только для проверки).
+//Для ротации в каталог кладётся новый ключ и указывается его ActiveKeyID, старый ключ
+//остаётся в каталоге, пока не истекут выданные им токены
+type JWTConfig struct {
+	KeysDir     string
+	ActiveKeyID string
+	Issuer      string
+}
+
+//Claims полезная нагрузка access-токена
+type Claims struct {
+	ID       string   `json:"jti"`
+	Issuer   string   `json:"iss,omitempty"`
+	Subject  string   `json:"sub"`
+	Kind     string   `json:"kind"`
+	Roles    []string `json:"roles,omitempty"`
+	IssuedAt int64    `json:"iat"`
+	Expire   int64    `json:"exp"`
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+type jwtKey struct {
+	id        string
+	algorithm string
+	public    crypto.PublicKey
+	private   crypto.Signer
+}
+
+//JWK открытый ключ в формате RFC 7517
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+//JWKS ...
+type JWKS struct {
+	Keys []*JWK `json:"keys"`
+}
+
+//JWTService выпускает и проверяет подписанные access-токены. Подпись, ключ, издатель и срок
+//проверяются без обращения к базе, а отзыв - по списку jti в памяти процесса, который пополняет
+//SessionService. Список не разделяется между экземплярами сервера: отозванный на другом экземпляре
+//токен остаётся действительным до истечения срока, поэтому срок подписанных токенов короткий
+type JWTService struct {
+	keys    map[string]*jwtKey
+	active  *jwtKey
+	issuer  string
+	mu      sync.Mutex
+	revoked map[string]time.Time
+}
+
+//NewJWTService загружает ключи из KeysDir. Без KeysDir сервис выключен и токены остаются непрозрачными
+func NewJWTService(config JWTConfig) (*JWTService, error) {
+	s := &JWTService{keys: make(map[string]*jwtKey), issuer: config.Issuer, revoked: make(map[string]time.Time)}
+	if config.KeysDir == "" {
+		return s, nil
+	}
+	files, err := ioutil.ReadDir(config.KeysDir)
+	if err != nil {
+		return nil, err
+	}
+	var signers []string
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		if file.IsDir() || (ext != ".key" && ext != ".pub") {
+			continue
+		}
+		id := strings.TrimSuffix(file.Name(), ext)
+		data, err := ioutil.ReadFile(filepath.Join(config.KeysDir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		key, err := parseJWTKey(id, data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file.Name(), err)
+		}
+		if existing, ok := s.keys[id]; ok && existing.private != nil {
+			continue
+		}
+		s.keys[id] = key
+		if key.private != nil {
+			signers = append(signers, id)
+		}
+	}
+	if len(signers) == 0 {
+		return nil, errors.New("no private keys in " + config.KeysDir)
+	}
+	sort.Strings(signers)
+	activeID := config.ActiveKeyID
+	if activeID == "" {
+		activeID = signers[len(signers)-1]
+	}
+	active, ok := s.keys[activeID]
+	if !ok || active.private == nil {
+		return nil, errors.New("no private key for kid " + activeID)
+	}
+	s.active = active
+	return s, nil
+}
+
+func parseJWTKey(id string, data []byte) (*jwtKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("can't decode pem block")
+	}
+	key := &jwtKey{id: id}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key.private = private
+	case "EC PRIVATE KEY":
+		private, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key.private = private
+	case "PRIVATE KEY":
+		private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := private.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("unsupported private key")
+		}
+		key.private = signer
+	case "PUBLIC KEY", "RSA PUBLIC KEY":
+		public, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			// keyGen сохраняет открытый RSA-ключ в формате PKCS#1
+			public, err = x509.ParsePKCS1PublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+		}
+		key.public = public
+	default:
+		return nil, errors.New("unsupported pem block " + block.Type)
+	}
+	if key.private != nil {
+		key.public = key.private.Public()
+	}
+	switch public := key.public.(type) {
+	case *rsa.PublicKey:
+		key.algorithm = "RS256"
+	case *ecdsa.PublicKey:
+		if public.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 curve is supported")
+		}
+		key.algorithm = "ES256"
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+	return key, nil
+}
+
+//Enabled ...
+func (s *JWTService) Enabled() bool {
+	return s != nil && s.active != nil
+}
+
+//Sign подписывает claims активным ключом
+func (s *JWTService) Sign(claims *Claims) (string, error) {
+	if !s.Enabled() {
+		return "", errors.New("jwt is not configured")
+	}
+	if claims.Issuer == "" {
+		claims.Issuer = s.issuer
+	}
+	header, err := json.Marshal(&jwtHeader{Algorithm: s.active.algorithm, Type: "JWT", KeyID: s.active.id})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch private := s.active.private.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, private, crypto.SHA256, digest[:])
+		if err != nil {
+			return "", err
+		}
+	case *ecdsa.PrivateKey:
+		r, sig, err := ecdsa.Sign(rand.Reader, private, digest[:])
+		if err != nil {
+			return "", err
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		sig.FillBytes(signature[32:])
+	default:
+		return "", errors.New("unsupported key type")
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+//LooksLikeJWT отличает JWT от непрозрачного hex-токена
+func LooksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+//Revoke заносит jti в список отозванных до момента until, после которого токен истёк бы и сам.
+//Записи с прошедшим сроком удаляются при каждом вызове, так что список не растёт дольше срока токенов
+func (s *JWTService) Revoke(id string, until time.Time) {
+	if !s.Enabled() || id == "" {
+		return
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for jti, expire := range s.revoked {
+		if !expire.After(now) {
+			delete(s.revoked, jti)
+		}
+	}
+	if until.After(now) {
+		s.revoked[id] = until
+	}
+}
+
+func (s *JWTService) isRevoked(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expire, ok := s.revoked[id]
+	return ok && expire.After(time.Now())
+}
+
+//Verify проверяет подпись, издателя, срок действия и отзыв токена без обращения к базе
+func (s *JWTService) Verify(token string) (*Claims, error) {
+	if !s.Enabled() {
+		return nil, ErrInvalidToken
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	headerData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	header := &jwtHeader{}
+	if err := json.Unmarshal(headerData, header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	key, ok := s.keys[header.KeyID]
+	if !ok || header.Algorithm != key.algorithm {
+		return nil, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch public := key.public.(type) {
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature) != nil {
+			return nil, ErrInvalidToken
+		}
+	case *ecdsa.PublicKey:
+		if len(signature) != 64 {
+			return nil, ErrInvalidToken
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		sig := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(public, digest[:], r, sig) {
+			return nil, ErrInvalidToken
+		}
+	default:
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	claims := &Claims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if s.issuer != "" && claims.Issuer != s.issuer {
+		return nil, ErrInvalidToken
+	}
+	if claims.Expire <= time.Now().Unix() {
+		return nil, ErrTokenExpired
+	}
+	if s.isRevoked(claims.ID) {
+		return nil, ErrTokenRevoked
+	}
+	return claims, nil
+}
+
+//JWKS возвращает открытые ключи для /.well-known/jwks.json, включая ключи, оставленные только для проверки
+func (s *JWTService) JWKS() *JWKS {
+	result := &JWKS{Keys: make([]*JWK, 0, len(s.keys))}
+	ids := make([]string, 0, len(s.keys))
+	for id := range s.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		key := s.keys[id]
+		jwk := &JWK{Use: "sig", Algorithm: key.algorithm, KeyID: key.id}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case *ecdsa.PublicKey:
+			x := make([]byte, 32)
+			y := make([]byte, 32)
+			public.X.FillBytes(x)
+			public.Y.FillBytes(y)
+			jwk.KeyType = "EC"
+			jwk.Curve = "P-256"
+			jwk.X = base64.RawURLEncoding.EncodeToString(x)
+			jwk.Y = base64.RawURLEncoding.EncodeToString(y)
+		}
+		result.Keys = append(result.Keys, jwk)
+	}
+	return result
+}
@@ -0,0 +1,166 @@
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//writeTestKeys кладёт в каталог ключи ES256 "ec" и RS256 "rsa"
+func writeTestKeys(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecData, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]*pem.Block{
+		"ec.key":  {Type: "EC PRIVATE KEY", Bytes: ecData},
+		"rsa.key": {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)},
+	}
+	for name, block := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+//withHeader заменяет заголовок подписанного токена, оставляя полезную нагрузку и подпись
+func withHeader(t *testing.T, token string, header *jwtHeader) string {
+	t.Helper()
+	data, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	return base64.RawURLEncoding.EncodeToString(data) + "." + parts[1] + "." + parts[2]
+}
+
+func TestJWTSignVerify(t *testing.T) {
+	dir := writeTestKeys(t)
+	now := time.Now()
+	claims := func(expire time.Time) *Claims {
+		return &Claims{ID: "jti", Subject: "42", Kind: KindManager, IssuedAt: now.Unix(), Expire: expire.Unix()}
+	}
+
+	for _, kid := range []string{"ec", "rsa"} {
+		t.Run(kid, func(t *testing.T) {
+			svc, err := NewJWTService(JWTConfig{KeysDir: dir, ActiveKeyID: kid, Issuer: "crud"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, err := NewJWTService(JWTConfig{KeysDir: writeTestKeys(t), ActiveKeyID: kid, Issuer: "crud"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			otherIssuer, err := NewJWTService(JWTConfig{KeysDir: dir, ActiveKeyID: kid, Issuer: "other"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sign := func(svc *JWTService, claims *Claims) string {
+				token, err := svc.Sign(claims)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return token
+			}
+			valid := sign(svc, claims(now.Add(time.Minute)))
+			otherAlgorithm := map[string]string{"ec": "RS256", "rsa": "ES256"}[kid]
+			parts := strings.Split(valid, ".")
+
+			tests := []struct {
+				name  string
+				token string
+				err   error
+			}{
+				{name: "valid", token: valid},
+				{name: "expired", token: sign(svc, claims(now.Add(-time.Second))), err: ErrTokenExpired},
+				{name: "foreign key with same kid", token: sign(other, claims(now.Add(time.Minute))), err: ErrInvalidToken},
+				{name: "other issuer", token: sign(otherIssuer, claims(now.Add(time.Minute))), err: ErrInvalidToken},
+				{name: "alg none", token: withHeader(t, valid, &jwtHeader{Algorithm: "none", Type: "JWT", KeyID: kid}), err: ErrInvalidToken},
+				{name: "alg of another key type", token: withHeader(t, valid, &jwtHeader{Algorithm: otherAlgorithm, Type: "JWT", KeyID: kid}), err: ErrInvalidToken},
+				{name: "unknown kid", token: withHeader(t, valid, &jwtHeader{Algorithm: "ES256", Type: "JWT", KeyID: "missing"}), err: ErrInvalidToken},
+				{name: "empty signature", token: parts[0] + "." + parts[1] + ".", err: ErrInvalidToken},
+				{name: "tampered payload", token: parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"1","kind":"manager","exp":9999999999}`)) + "." + parts[2], err: ErrInvalidToken},
+				{name: "not a jwt", token: "abc", err: ErrInvalidToken},
+			}
+			for _, test := range tests {
+				t.Run(test.name, func(t *testing.T) {
+					result, err := svc.Verify(test.token)
+					if !errors.Is(err, test.err) {
+						t.Fatalf("err = %v, want %v", err, test.err)
+					}
+					if err == nil && (result.Subject != "42" || result.Kind != KindManager || result.Issuer != "crud") {
+						t.Errorf("claims = %+v", result)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestJWTDisabled(t *testing.T) {
+	svc, err := NewJWTService(JWTConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svc.Enabled() {
+		t.Fatal("service without keys must be disabled")
+	}
+	if _, err := svc.Verify("a.b.c"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("err = %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestJWTRevoke(t *testing.T) {
+	svc, err := NewJWTService(JWTConfig{KeysDir: writeTestKeys(t), ActiveKeyID: "ec"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	sign := func(id string) string {
+		token, err := svc.Sign(&Claims{ID: id, Subject: "42", Kind: KindCustomer, IssuedAt: now.Unix(), Expire: now.Add(time.Minute).Unix()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	revoked, kept := sign("revoked"), sign("kept")
+
+	svc.Revoke("revoked", now.Add(time.Minute))
+	svc.revoked["stale"] = now.Add(-time.Second)
+	if _, err := svc.Verify(revoked); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("revoked: err = %v, want %v", err, ErrTokenRevoked)
+	}
+	if _, err := svc.Verify(kept); err != nil {
+		t.Errorf("kept: err = %v", err)
+	}
+
+	svc.Revoke("other", now.Add(time.Minute))
+	if _, ok := svc.revoked["stale"]; ok {
+		t.Error("expired entry must be pruned")
+	}
+	if len(svc.revoked) != 2 {
+		t.Errorf("revoked = %v, want 2 entries", svc.revoked)
+	}
+}
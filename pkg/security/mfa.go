@@ -0,0 +1,477 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"log"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidCode         = errors.New("invalid code")
+	ErrNoSuchChallenge     = errors.New("no such challenge")
+	ErrMFANotEnrolled      = errors.New("mfa not enrolled")
+	ErrMFAAlreadyEnrolled  = errors.New("mfa already enrolled")
+	ErrMFARequired         = errors.New("mfa required for role")
+	ErrTooManyCodeAttempts = errors.New("too many code attempts")
+)
+
+//ThrottleKindMFA неверные коды второго шага учитываются отдельно от паролей:
+//успешный вход по паролю обнуляет счётчик паролей и не должен обнулять счётчик кодов
+const ThrottleKindMFA = "manager_mfa"
+
+const (
+	recoveryCodesCount   = 10
+	challengeMaxAttempts = 5
+	defaultChallengeTTL  = 5 * time.Minute
+	defaultMFAIssuer     = "crud"
+)
+
+//MFAConfig настройки второго фактора для менеджеров.
+//Менеджеры с ролью из RequiredRoles не получат токен без TOTP
+type MFAConfig struct {
+	Issuer        string
+	RequiredRoles []string
+	ChallengeTTL  time.Duration
+}
+
+//TOTPEnrolment секрет и ссылка otpauth:// для подключения приложения-аутентификатора
+type TOTPEnrolment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+//MFAChallenge выдаётся после проверки пароля, токен выдаётся после проверки кода.
+//Enrolment заполнен, если второй фактор обязателен, но ещё не подключён
+type MFAChallenge struct {
+	Challenge string         `json:"challenge"`
+	Expire    time.Time      `json:"expire"`
+	Enrolment *TOTPEnrolment `json:"enrolment,omitempty"`
+}
+
+//LoginResult результат проверки пароля: либо токены, либо запрос второго фактора
+type LoginResult struct {
+	*TokenPair
+	MFA           *MFAChallenge `json:"mfa,omitempty"`
+	RecoveryCodes []string      `json:"recoveryCodes,omitempty"`
+}
+
+//MFAService хранит TOTP-секреты, коды восстановления и незавершённые входы менеджеров
+type MFAService struct {
+	pool       *pgxpool.Pool
+	sessionSvc *SessionService
+	config     MFAConfig
+}
+
+//NewMFAService ..
+func NewMFAService(pool *pgxpool.Pool, sessionSvc *SessionService, config MFAConfig) *MFAService {
+	if config.Issuer == "" {
+		config.Issuer = defaultMFAIssuer
+	}
+	if config.ChallengeTTL <= 0 {
+		config.ChallengeTTL = defaultChallengeTTL
+	}
+	return &MFAService{pool: pool, sessionSvc: sessionSvc, config: config}
+}
+
+//RequiredFor сообщает, обязателен ли второй фактор для набора ролей
+func (s *MFAService) RequiredFor(roles []string) bool {
+	for _, role := range roles {
+		for _, required := range s.config.RequiredRoles {
+			if strings.EqualFold(role, required) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//Enabled сообщает, подключён ли у менеджера TOTP
+func (s *MFAService) Enabled(ctx context.Context, managerID int64) (bool, error) {
+	var enabled bool
+	err := s.pool.QueryRow(ctx, `SELECT enabled FROM managers_totp WHERE manager_id = $1`, managerID).Scan(&enabled)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		log.Println(err)
+		return false, ErrInternal
+	}
+	return enabled, nil
+}
+
+//Needed сообщает, нужен ли менеджеру второй фактор: подключён TOTP или он обязателен для его ролей
+func (s *MFAService) Needed(ctx context.Context, managerID int64) (bool, error) {
+	enabled, err := s.Enabled(ctx, managerID)
+	if err != nil || enabled {
+		return enabled, err
+	}
+	_, roles, err := s.managerInfo(ctx, managerID)
+	if err != nil {
+		return false, err
+	}
+	return s.RequiredFor(roles), nil
+}
+
+//managerInfo возвращает телефон (имя учётной записи в приложении) и роли менеджера
+func (s *MFAService) managerInfo(ctx context.Context, managerID int64) (string, []string, error) {
+	var phone string
+	var roles []string
+	err := s.pool.QueryRow(ctx, `SELECT phone, roles FROM managers WHERE id = $1`, managerID).Scan(&phone, &roles)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil, ErrNoSuchUser
+	}
+	if err != nil {
+		log.Println(err)
+		return "", nil, ErrInternal
+	}
+	return phone, roles, nil
+}
+
+//BeginEnrolment возвращает неподтверждённый секрет, создавая его при первом вызове.
+//Выданный секрет не заменяется до подтверждения или отключения, иначе следующий вход
+//с паролем подменил бы секрет, который менеджер уже добавил в приложение
+func (s *MFAService) BeginEnrolment(ctx context.Context, managerID int64) (*TOTPEnrolment, error) {
+	enabled, err := s.Enabled(ctx, managerID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrMFAAlreadyEnrolled
+	}
+	account, _, err := s.managerInfo(ctx, managerID)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	err = s.pool.QueryRow(ctx, `
+INSERT INTO managers_totp(manager_id, secret) VALUES($1, $2)
+ON CONFLICT (manager_id) DO UPDATE SET secret = managers_totp.secret RETURNING secret`,
+		managerID, secret).Scan(&secret)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return &TOTPEnrolment{Secret: secret, URI: TOTPURI(s.config.Issuer, account, secret)}, nil
+}
+
+//ConfirmEnrolment включает TOTP после первого верного кода и возвращает коды восстановления
+func (s *MFAService) ConfirmEnrolment(ctx context.Context, managerID int64, code string) ([]string, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			log.Println(err)
+		}
+	}()
+	codes, err := s.confirm(ctx, tx, managerID, code)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return codes, nil
+}
+
+func (s *MFAService) confirm(ctx context.Context, tx pgx.Tx, managerID int64, code string) ([]string, error) {
+	var secret string
+	var enabled bool
+	var lastStep int64
+	err := tx.QueryRow(ctx, `
+SELECT secret, enabled, last_step FROM managers_totp WHERE manager_id = $1 FOR UPDATE`, managerID).Scan(&secret, &enabled, &lastStep)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrMFANotEnrolled
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	if enabled {
+		return nil, ErrMFAAlreadyEnrolled
+	}
+	step, ok := ValidateTOTP(secret, code, time.Now(), lastStep)
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+	_, err = tx.Exec(ctx, `UPDATE managers_totp SET enabled = TRUE, last_step = $2 WHERE manager_id = $1`, managerID, step)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return s.replaceRecoveryCodes(ctx, tx, managerID)
+}
+
+//recoveryCode 80 случайных бит в виде 20 hex-символов группами по пять: xxxxx-xxxxx-xxxxx-xxxxx.
+//Коды хранятся как быстрый отпечаток, поэтому стойкость к перебору даёт только их длина
+func recoveryCode() (string, error) {
+	value, err := randomHex(10)
+	if err != nil {
+		return "", err
+	}
+	groups := make([]string, 0, len(value)/5)
+	for i := 0; i < len(value); i += 5 {
+		groups = append(groups, value[i:i+5])
+	}
+	return strings.Join(groups, "-"), nil
+}
+
+func (s *MFAService) replaceRecoveryCodes(ctx context.Context, tx pgx.Tx, managerID int64) ([]string, error) {
+	_, err := tx.Exec(ctx, `DELETE FROM managers_recovery_codes WHERE manager_id = $1`, managerID)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	codes := make([]string, 0, recoveryCodesCount)
+	for i := 0; i < recoveryCodesCount; i++ {
+		code, err := recoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(ctx, `
+INSERT INTO managers_recovery_codes(manager_id, code_hash) VALUES($1, $2)`, managerID, s.sessionSvc.Digest(code))
+		if err != nil {
+			log.Println(err)
+			return nil, ErrInternal
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+//RegenerateRecoveryCodes выдаёт новый набор кодов восстановления, старые перестают действовать
+func (s *MFAService) RegenerateRecoveryCodes(ctx context.Context, managerID int64, code string) ([]string, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			log.Println(err)
+		}
+	}()
+	if err := s.verify(ctx, tx, managerID, code, ""); err != nil {
+		return nil, err
+	}
+	codes, err := s.replaceRecoveryCodes(ctx, tx, managerID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return codes, nil
+}
+
+//Disable отключает TOTP. Для ролей с обязательным вторым фактором отключение запрещено
+func (s *MFAService) Disable(ctx context.Context, managerID int64, code string) error {
+	_, roles, err := s.managerInfo(ctx, managerID)
+	if err != nil {
+		return err
+	}
+	if s.RequiredFor(roles) {
+		return ErrMFARequired
+	}
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			log.Println(err)
+		}
+	}()
+	if err := s.verify(ctx, tx, managerID, code, ""); err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `DELETE FROM managers_recovery_codes WHERE manager_id = $1`, managerID)
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	_, err = tx.Exec(ctx, `DELETE FROM managers_totp WHERE manager_id = $1`, managerID)
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	return nil
+}
+
+//verify проверяет TOTP-код или одноразовый код восстановления подключённого второго фактора
+func (s *MFAService) verify(ctx context.Context, tx pgx.Tx, managerID int64, code string, recoveryCode string) error {
+	var secret string
+	var enabled bool
+	var lastStep int64
+	err := tx.QueryRow(ctx, `
+SELECT secret, enabled, last_step FROM managers_totp WHERE manager_id = $1 FOR UPDATE`, managerID).Scan(&secret, &enabled, &lastStep)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && !enabled) {
+		return ErrMFANotEnrolled
+	}
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	if recoveryCode != "" {
+		tag, err := tx.Exec(ctx, `
+UPDATE managers_recovery_codes SET used = CURRENT_TIMESTAMP
+WHERE manager_id = $1 AND code_hash = $2 AND used IS NULL`, managerID, s.sessionSvc.Digest(strings.TrimSpace(recoveryCode)))
+		if err != nil {
+			log.Println(err)
+			return ErrInternal
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrInvalidCode
+		}
+		return nil
+	}
+	step, ok := ValidateTOTP(secret, code, time.Now(), lastStep)
+	if !ok {
+		return ErrInvalidCode
+	}
+	_, err = tx.Exec(ctx, `UPDATE managers_totp SET last_step = $2 WHERE manager_id = $1`, managerID, step)
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	return nil
+}
+
+//Challenge решает, нужен ли второй шаг входа, и если нужен, создаёт его.
+//Возвращает nil, если можно сразу выдавать токены
+func (s *MFAService) Challenge(ctx context.Context, managerID int64) (*MFAChallenge, error) {
+	enabled, err := s.Enabled(ctx, managerID)
+	if err != nil {
+		return nil, err
+	}
+	challenge := &MFAChallenge{}
+	if !enabled {
+		_, roles, err := s.managerInfo(ctx, managerID)
+		if err != nil {
+			return nil, err
+		}
+		if !s.RequiredFor(roles) {
+			return nil, nil
+		}
+		challenge.Enrolment, err = s.BeginEnrolment(ctx, managerID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	challenge.Challenge, err = randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+	err = s.pool.QueryRow(ctx, `
+INSERT INTO mfa_challenges(token_hash, manager_id, expire)
+VALUES($1, $2, CURRENT_TIMESTAMP + make_interval(secs => $3)) RETURNING expire`,
+		s.sessionSvc.Digest(challenge.Challenge), managerID, s.config.ChallengeTTL.Seconds()).Scan(&challenge.Expire)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return challenge, nil
+}
+
+//ChallengePhone номер менеджера, которому выдан действующий MFA-запрос.
+//По нему неверные коды учитываются в LoginThrottle
+func (s *MFAService) ChallengePhone(ctx context.Context, challenge string) (string, error) {
+	var phone string
+	err := s.pool.QueryRow(ctx, `
+SELECT m.phone FROM mfa_challenges c JOIN managers m ON m.id = c.manager_id
+WHERE c.token_hash = $1 AND c.used IS NULL AND c.expire > CURRENT_TIMESTAMP`,
+		s.sessionSvc.Digest(challenge)).Scan(&phone)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrNoSuchChallenge
+	}
+	if err != nil {
+		log.Println(err)
+		return "", ErrInternal
+	}
+	return phone, nil
+}
+
+//CompleteChallenge проверяет код второго шага и возвращает менеджера.
+//Если TOTP подключался в рамках этого входа, возвращаются и коды восстановления
+func (s *MFAService) CompleteChallenge(ctx context.Context, challenge string, code string, recoveryCode string) (int64, []string, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		log.Println(err)
+		return 0, nil, ErrInternal
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			log.Println(err)
+		}
+	}()
+
+	var id, managerID int64
+	var attempts int
+	err = tx.QueryRow(ctx, `
+SELECT id, manager_id, attempts FROM mfa_challenges
+WHERE token_hash = $1 AND used IS NULL AND expire > CURRENT_TIMESTAMP FOR UPDATE`,
+		s.sessionSvc.Digest(challenge)).Scan(&id, &managerID, &attempts)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil, ErrNoSuchChallenge
+	}
+	if err != nil {
+		log.Println(err)
+		return 0, nil, ErrInternal
+	}
+	if attempts >= challengeMaxAttempts {
+		return 0, nil, ErrTooManyCodeAttempts
+	}
+
+	var enabled bool
+	err = tx.QueryRow(ctx, `SELECT enabled FROM managers_totp WHERE manager_id = $1`, managerID).Scan(&enabled)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		log.Println(err)
+		return 0, nil, ErrInternal
+	}
+	var codes []string
+	if enabled {
+		err = s.verify(ctx, tx, managerID, code, recoveryCode)
+	} else {
+		codes, err = s.confirm(ctx, tx, managerID, code)
+	}
+	if errors.Is(err, ErrInvalidCode) {
+		// транзакция откатывается до учёта попытки, иначе UPDATE ждал бы её блокировку строки
+		if rerr := tx.Rollback(ctx); rerr != nil {
+			log.Println(rerr)
+		}
+		_, uerr := s.pool.Exec(ctx, `UPDATE mfa_challenges SET attempts = attempts + 1 WHERE id = $1`, id)
+		if uerr != nil {
+			log.Println(uerr)
+		}
+		return 0, nil, err
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	_, err = tx.Exec(ctx, `UPDATE mfa_challenges SET used = CURRENT_TIMESTAMP WHERE id = $1`, id)
+	if err != nil {
+		log.Println(err)
+		return 0, nil, ErrInternal
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Println(err)
+		return 0, nil, ErrInternal
+	}
+	return managerID, codes, nil
+}
@@ -0,0 +1,217 @@
+package security
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sidalsoft/crud/pkg/sms"
+	"log"
+	"math"
+	"math/big"
+	"time"
+)
+
+//Назначения одноразовых кодов
+const (
+	OTPPasswordReset = "password_reset"
+	OTPPhoneVerify   = "phone_verify"
+	OTPPhoneChange   = "phone_change"
+)
+
+//OTPConfig настройки одноразовых кодов из SMS
+type OTPConfig struct {
+	TTL         time.Duration
+	MaxAttempts int
+	Cooldown    time.Duration
+}
+
+//OTPCooldownError новый код на этот номер можно запросить только через RetryAfter
+type OTPCooldownError struct {
+	RetryAfter time.Duration
+}
+
+func (e *OTPCooldownError) Error() string {
+	return fmt.Sprintf("code already sent, retry after %s", e.RetryAfter)
+}
+
+//OTPService выдаёт и проверяет одноразовые коды. В базе хранится только хэш кода,
+//привязанный к назначению и номеру телефона
+type OTPService struct {
+	pool       *pgxpool.Pool
+	sessionSvc *SessionService
+	sender     sms.Sender
+	config     OTPConfig
+}
+
+//NewOTPService ..
+func NewOTPService(pool *pgxpool.Pool, sessionSvc *SessionService, sender sms.Sender, config OTPConfig) *OTPService {
+	if config.TTL <= 0 {
+		config.TTL = 10 * time.Minute
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 5
+	}
+	if config.Cooldown <= 0 {
+		config.Cooldown = time.Minute
+	}
+	return &OTPService{pool: pool, sessionSvc: sessionSvc, sender: sender, config: config}
+}
+
+var otpMessages = map[string]string{
+	OTPPasswordReset: "Код для сброса пароля: %s",
+	OTPPhoneVerify:   "Код подтверждения номера: %s",
+	OTPPhoneChange:   "Код для смены номера: %s",
+}
+
+func (s *OTPService) digest(purpose string, phone string, code string) string {
+	return s.sessionSvc.Digest(purpose + ":" + phone + ":" + code)
+}
+
+//Send отправляет новый код на phone. Предыдущие неиспользованные коды с тем же назначением перестают действовать
+func (s *OTPService) Send(ctx context.Context, kind string, purpose string, phone string, ownerID int64) error {
+	var seconds *float64
+	err := s.pool.QueryRow(ctx, `
+SELECT EXTRACT(EPOCH FROM max(created) + make_interval(secs => $4) - CURRENT_TIMESTAMP)::float8 FROM otp_codes
+WHERE kind = $1 AND purpose = $2 AND phone = $3`, kind, purpose, phone, s.config.Cooldown.Seconds()).Scan(&seconds)
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	if seconds != nil && *seconds > 0 {
+		return &OTPCooldownError{RetryAfter: time.Duration(math.Ceil(*seconds)) * time.Second}
+	}
+
+	number, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	code := fmt.Sprintf("%06d", number.Int64())
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && err != pgx.ErrTxClosed {
+			log.Println(err)
+		}
+	}()
+
+	_, err = tx.Exec(ctx, `
+UPDATE otp_codes SET used = CURRENT_TIMESTAMP
+WHERE kind = $1 AND purpose = $2 AND phone = $3 AND used IS NULL`, kind, purpose, phone)
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	_, err = tx.Exec(ctx, `
+INSERT INTO otp_codes(kind, purpose, phone, owner_id, code_hash, expire)
+VALUES($1, $2, $3, $4, $5, CURRENT_TIMESTAMP + make_interval(secs => $6))`,
+		kind, purpose, phone, ownerID, s.digest(purpose, phone, code), s.config.TTL.Seconds())
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+
+	if err := s.sender.Send(ctx, phone, fmt.Sprintf(otpMessages[purpose], code)); err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	return nil
+}
+
+//SendInBackground отправляет код, не задерживая ответ: ни код ответа, ни его время не зависят от того,
+//зарегистрирован ли номер и не запрашивали ли код недавно. Ошибки, кроме паузы между кодами, пишутся в лог
+func (s *OTPService) SendInBackground(kind string, purpose string, phone string, ownerID int64) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		err := s.Send(ctx, kind, purpose, phone, ownerID)
+		var cooldown *OTPCooldownError
+		if err != nil && !errors.As(err, &cooldown) {
+			log.Println(err)
+		}
+	}()
+}
+
+//Verify проверяет код и возвращает пользователя, для которого он был выпущен. Код действует один раз,
+//после MaxAttempts неверных попыток код перестаёт приниматься и нужно запросить новый
+func (s *OTPService) Verify(ctx context.Context, kind string, purpose string, phone string, code string) (int64, error) {
+	var ownerID int64
+	err := s.Use(ctx, kind, purpose, phone, code, func(id int64) error {
+		ownerID = id
+		return nil
+	})
+	return ownerID, err
+}
+
+//Use проверяет код и вызывает use для пользователя, для которого он был выпущен.
+//Код гасится, только если use завершился без ошибки: отказ внутри use не сжигает верный код
+func (s *OTPService) Use(ctx context.Context, kind string, purpose string, phone string, code string, use func(ownerID int64) error) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && err != pgx.ErrTxClosed {
+			log.Println(err)
+		}
+	}()
+
+	var id, ownerID int64
+	var hash string
+	var attempts int
+	err = tx.QueryRow(ctx, `
+SELECT id, owner_id, code_hash, attempts FROM otp_codes
+WHERE kind = $1 AND purpose = $2 AND phone = $3 AND used IS NULL AND expire > CURRENT_TIMESTAMP
+ORDER BY created DESC LIMIT 1
+FOR UPDATE`, kind, purpose, phone).Scan(&id, &ownerID, &hash, &attempts)
+	if err == pgx.ErrNoRows {
+		return ErrInvalidCode
+	}
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	if attempts >= s.config.MaxAttempts {
+		return ErrTooManyCodeAttempts
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(s.digest(purpose, phone, code))) != 1 {
+		_, err = tx.Exec(ctx, `UPDATE otp_codes SET attempts = attempts + 1 WHERE id = $1`, id)
+		if err != nil {
+			log.Println(err)
+			return ErrInternal
+		}
+		if err := tx.Commit(ctx); err != nil {
+			log.Println(err)
+			return ErrInternal
+		}
+		return ErrInvalidCode
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE otp_codes SET used = CURRENT_TIMESTAMP WHERE id = $1`, id)
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	if err := use(ownerID); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	return nil
+}
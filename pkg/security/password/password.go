@@ -0,0 +1,299 @@
+package password
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+//PolicyError пароль не подходит под политику, Reason можно показать пользователю
+type PolicyError struct {
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return e.Reason
+}
+
+var (
+	ErrTooShort  = &PolicyError{Reason: "password is too short"}
+	ErrTooLong   = &PolicyError{Reason: "password is too long"}
+	ErrTooCommon = &PolicyError{Reason: "password is too common"}
+	ErrReused    = &PolicyError{Reason: "password was used recently"}
+)
+
+var (
+	ErrNotFound = errors.New("item not found")
+	ErrInternal = errors.New("internal error")
+)
+
+//bcrypt учитывает только первые 72 байта пароля
+const maxLength = 72
+
+//Config политика паролей.
+//DenyListFile - файл со скомпрометированными и популярными паролями, по одному в строке.
+//HistorySize - сколько последних паролей, включая текущий, нельзя использовать повторно
+type Config struct {
+	MinLength    int
+	DenyListFile string
+	HistorySize  int
+	Cost         int
+}
+
+//defaultDenyList используется, если файл не задан
+var defaultDenyList = []string{
+	"password", "password1", "12345678", "123456789", "1234567890", "qwerty123", "qwertyuiop",
+	"11111111", "00000000", "iloveyou", "admin123", "welcome1",
+}
+
+//tables таблицы с текущим паролем для каждого вида пользователей
+var tables = map[string]string{
+	"customer": "customers",
+	"manager":  "managers",
+}
+
+//Service хэширует и проверяет пароли, следит за политикой и историей паролей
+type Service struct {
+	pool      *pgxpool.Pool
+	config    Config
+	denyList  map[string]bool
+	dummyHash []byte
+}
+
+//NewService загружает список запрещённых паролей
+func NewService(pool *pgxpool.Pool, config Config) (*Service, error) {
+	if config.MinLength <= 0 {
+		config.MinLength = 8
+	}
+	if config.Cost == 0 {
+		config.Cost = bcrypt.DefaultCost
+	}
+	if config.Cost < bcrypt.MinCost || config.Cost > bcrypt.MaxCost {
+		return nil, errors.New("invalid bcrypt cost")
+	}
+	s := &Service{pool: pool, config: config, denyList: make(map[string]bool)}
+	if config.DenyListFile == "" {
+		for _, item := range defaultDenyList {
+			s.denyList[item] = true
+		}
+	} else if err := s.loadDenyList(config.DenyListFile); err != nil {
+		return nil, err
+	}
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte("dummy password"), config.Cost)
+	if err != nil {
+		return nil, err
+	}
+	s.dummyHash = dummyHash
+	return s, nil
+}
+
+func (s *Service) loadDenyList(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		s.denyList[strings.ToLower(line)] = true
+	}
+	return scanner.Err()
+}
+
+//Validate проверяет длину пароля и отсутствие его в списке запрещённых
+func (s *Service) Validate(password string) error {
+	if utf8.RuneCountInString(password) < s.config.MinLength {
+		return ErrTooShort
+	}
+	if len(password) > maxLength {
+		return ErrTooLong
+	}
+	if s.denyList[strings.ToLower(password)] {
+		return ErrTooCommon
+	}
+	return nil
+}
+
+//Hash проверяет пароль по политике и возвращает bcrypt-хэш с настроенной стоимостью
+func (s *Service) Hash(password string) (string, error) {
+	if err := s.Validate(password); err != nil {
+		return "", err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), s.config.Cost)
+	if err != nil {
+		log.Println(err)
+		return "", ErrInternal
+	}
+	return string(hash), nil
+}
+
+//Compare сравнивает пароль с хэшем
+func (s *Service) Compare(hash string, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+//CompareDummy тратит на проверку столько же времени, сколько настоящая проверка пароля,
+//чтобы время ответа не выдавало существование номера
+func (s *Service) CompareDummy(password string) {
+	_ = bcrypt.CompareHashAndPassword(s.dummyHash, []byte(password))
+}
+
+//NeedsRehash хэш посчитан с другой стоимостью и должен быть пересчитан
+func (s *Service) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != s.config.Cost
+}
+
+//Rehash пересчитывает хэш после успешного входа, если изменилась стоимость.
+//Политика здесь не проверяется: пароль уже принят, а пользователь может не знать о новых правилах
+func (s *Service) Rehash(ctx context.Context, kind string, ownerID int64, password string, hash string) {
+	if !s.NeedsRehash(hash) {
+		return
+	}
+	table, ok := tables[kind]
+	if !ok {
+		return
+	}
+	newHash, err := bcrypt.GenerateFromPassword([]byte(password), s.config.Cost)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	_, err = s.pool.Exec(ctx, `UPDATE `+table+` SET password = $2 WHERE id = $1 AND password = $3`, ownerID, string(newHash), hash)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+//Change меняет пароль пользователя с проверкой политики и истории.
+//Старый хэш попадает в password_history, история обрезается до HistorySize
+func (s *Service) Change(ctx context.Context, kind string, ownerID int64, password string) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && err != pgx.ErrTxClosed {
+			log.Println(err)
+		}
+	}()
+
+	if err := s.ChangeTx(ctx, tx, kind, ownerID, password); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	return nil
+}
+
+//ChangeTx то же, что Change, но в транзакции вызывающего: так смена пароля фиксируется
+//вместе с другими изменениями учётной записи и отзывом сессий
+func (s *Service) ChangeTx(ctx context.Context, tx pgx.Tx, kind string, ownerID int64, password string) error {
+	table, ok := tables[kind]
+	if !ok {
+		return ErrInternal
+	}
+	if err := s.Validate(password); err != nil {
+		return err
+	}
+
+	var current string
+	err := tx.QueryRow(ctx, `SELECT password FROM `+table+` WHERE id = $1 FOR UPDATE`, ownerID).Scan(&current)
+	if err == pgx.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+
+	if s.config.HistorySize > 0 {
+		previous, err := s.history(ctx, tx, kind, ownerID, s.config.HistorySize-1)
+		if err != nil {
+			return err
+		}
+		for _, hash := range append([]string{current}, previous...) {
+			if hash != "" && s.Compare(hash, password) {
+				return ErrReused
+			}
+		}
+	}
+
+	hash, err := s.Hash(password)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `UPDATE `+table+` SET password = $2 WHERE id = $1`, ownerID, hash)
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	if current != "" && s.config.HistorySize > 1 {
+		_, err = tx.Exec(ctx, `INSERT INTO password_history(kind, owner_id, hash) VALUES($1, $2, $3)`, kind, ownerID, current)
+		if err != nil {
+			log.Println(err)
+			return ErrInternal
+		}
+	}
+	_, err = tx.Exec(ctx, `
+DELETE FROM password_history WHERE kind = $1 AND owner_id = $2 AND id NOT IN (
+  SELECT id FROM password_history WHERE kind = $1 AND owner_id = $2 ORDER BY created DESC, id DESC LIMIT $3)`,
+		kind, ownerID, s.maxHistory())
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	return nil
+}
+
+//maxHistory сколько прошлых хэшей хранить, кроме текущего
+func (s *Service) maxHistory() int {
+	if s.config.HistorySize <= 1 {
+		return 0
+	}
+	return s.config.HistorySize - 1
+}
+
+func (s *Service) history(ctx context.Context, tx pgx.Tx, kind string, ownerID int64, limit int) ([]string, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	rows, err := tx.Query(ctx, `
+SELECT hash FROM password_history WHERE kind = $1 AND owner_id = $2 ORDER BY created DESC, id DESC LIMIT $3`,
+		kind, ownerID, limit)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	defer rows.Close()
+
+	items := make([]string, 0, limit)
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			log.Println(err)
+			return nil, ErrInternal
+		}
+		items = append(items, hash)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return items, nil
+}
@@ -0,0 +1,319 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"log"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoSuchRole        = errors.New("no such role")
+	ErrInvalidRole       = errors.New("invalid role")
+	ErrUnknownRole       = errors.New("unknown role")
+	ErrUnknownPermission = errors.New("unknown permission")
+	ErrProtectedRole     = errors.New("role can't be deleted")
+)
+
+//Встроенные роли. ADMIN получает все права, MANAGER назначается новым менеджерам по умолчанию
+const (
+	RoleAdmin   = "ADMIN"
+	RoleManager = "MANAGER"
+)
+
+//Права доступа в формате <ресурс>:<действие>[:<область>]
+const (
+	PermProductsRead       = "products:read"
+	PermProductsWrite      = "products:write"
+	PermProductsDelete     = "products:delete"
+	PermCustomersRead      = "customers:read"
+	PermCustomersWrite     = "customers:write"
+	PermCustomersDelete    = "customers:delete"
+	PermSalesRead          = "sales:read"
+	PermSalesReadAll       = "sales:read:all"
+	PermSalesWrite         = "sales:write"
+	PermSalesPriceOverride = "sales:price_override"
+	PermManagersRead       = "managers:read"
+	PermManagersWrite      = "managers:write"
+	PermSessionsRevoke     = "sessions:revoke"
+	PermLockoutsRead       = "lockouts:read"
+	PermRolesRead          = "roles:read"
+	PermRolesWrite         = "roles:write"
+	PermAPIKeysRead        = "api_keys:read"
+	PermAPIKeysWrite       = "api_keys:write"
+	PermAPIKeysAdmin       = "api_keys:admin"
+	PermAuditRead          = "audit:read"
+)
+
+//Role роль и её права
+type Role struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Permissions []string  `json:"permissions"`
+	Created     time.Time `json:"created"`
+}
+
+//Permission ...
+type Permission struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+//RBACService хранит роли и их права. Менеджерам роли назначаются по имени в managers.roles
+type RBACService struct {
+	pool *pgxpool.Pool
+}
+
+//NewRBACService ..
+func NewRBACService(pool *pgxpool.Pool) *RBACService {
+	return &RBACService{pool: pool}
+}
+
+//ManagerPermissions права активного менеджера по всем его ролям
+func (s *RBACService) ManagerPermissions(ctx context.Context, managerID int64) ([]string, error) {
+	return s.permissions(ctx, `
+SELECT DISTINCT p.name FROM managers m
+JOIN roles r ON r.name = ANY(m.roles)
+JOIN role_permissions rp ON rp.role_id = r.id
+JOIN permissions p ON p.id = rp.permission_id
+WHERE m.id = $1 AND `+ActiveCondition("m.")+`
+ORDER BY p.name`, managerID)
+}
+
+func (s *RBACService) permissions(ctx context.Context, sql string, arg interface{}) ([]string, error) {
+	rows, err := s.pool.Query(ctx, sql, arg)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	defer rows.Close()
+
+	items := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			log.Println(err)
+			return nil, ErrInternal
+		}
+		items = append(items, name)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return items, nil
+}
+
+//Permissions справочник всех прав
+func (s *RBACService) Permissions(ctx context.Context) ([]*Permission, error) {
+	rows, err := s.pool.Query(ctx, `SELECT name, description FROM permissions ORDER BY name`)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	defer rows.Close()
+
+	items := make([]*Permission, 0)
+	for rows.Next() {
+		item := &Permission{}
+		if err := rows.Scan(&item.Name, &item.Description); err != nil {
+			log.Println(err)
+			return nil, ErrInternal
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return items, nil
+}
+
+//Roles все роли вместе с правами
+func (s *RBACService) Roles(ctx context.Context) ([]*Role, error) {
+	rows, err := s.pool.Query(ctx, `
+SELECT r.id, r.name, r.description,
+       COALESCE(array_agg(p.name ORDER BY p.name) FILTER (WHERE p.name IS NOT NULL), '{}'), r.created
+FROM roles r
+LEFT JOIN role_permissions rp ON rp.role_id = r.id
+LEFT JOIN permissions p ON p.id = rp.permission_id
+GROUP BY r.id
+ORDER BY r.name`)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	defer rows.Close()
+
+	items := make([]*Role, 0)
+	for rows.Next() {
+		item := &Role{}
+		err := rows.Scan(
+			&item.ID,
+			&item.Name,
+			&item.Description,
+			&item.Permissions,
+			&item.Created,
+		)
+		if err != nil {
+			log.Println(err)
+			return nil, ErrInternal
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return items, nil
+}
+
+//SaveRole создаёт роль или заменяет описание и права существующей роли с тем же именем
+func (s *RBACService) SaveRole(ctx context.Context, role *Role) (*Role, error) {
+	role.Name = strings.ToUpper(strings.TrimSpace(role.Name))
+	if role.Name == "" || strings.ContainsAny(role.Name, " ,{}\"") {
+		return nil, ErrInvalidRole
+	}
+	permissions := unique(role.Permissions)
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && err != pgx.ErrTxClosed {
+			log.Println(err)
+		}
+	}()
+
+	item := &Role{Name: role.Name, Description: role.Description, Permissions: permissions}
+	err = tx.QueryRow(ctx, `
+INSERT INTO roles(name, description) VALUES($1, $2)
+ON CONFLICT (name) DO UPDATE SET description = EXCLUDED.description
+RETURNING id, created`, item.Name, item.Description).Scan(&item.ID, &item.Created)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	_, err = tx.Exec(ctx, `DELETE FROM role_permissions WHERE role_id = $1`, item.ID)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	tag, err := tx.Exec(ctx, `
+INSERT INTO role_permissions(role_id, permission_id)
+SELECT $1, id FROM permissions WHERE name = ANY($2)`, item.ID, permissions)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	if int(tag.RowsAffected()) != len(permissions) {
+		return nil, ErrUnknownPermission
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return item, nil
+}
+
+//DeleteRole удаляет роль и снимает её со всех менеджеров. Встроенные роли удалить нельзя
+func (s *RBACService) DeleteRole(ctx context.Context, name string) error {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if name == RoleAdmin || name == RoleManager {
+		return ErrProtectedRole
+	}
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && err != pgx.ErrTxClosed {
+			log.Println(err)
+		}
+	}()
+
+	tag, err := tx.Exec(ctx, `DELETE FROM roles WHERE name = $1`, name)
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNoSuchRole
+	}
+	_, err = tx.Exec(ctx, `UPDATE managers SET roles = array_remove(roles, $1) WHERE $1 = ANY(roles)`, name)
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	return nil
+}
+
+//ResolveRoles приводит имена ролей к виду, в котором они хранятся,
+//и возвращает ErrUnknownRole, если какой-то из ролей нет в справочнике
+func (s *RBACService) ResolveRoles(ctx context.Context, roles []string) ([]string, error) {
+	roles = roleNames(roles)
+	var count int
+	err := s.pool.QueryRow(ctx, `SELECT count(*) FROM roles WHERE name = ANY($1)`, roles).Scan(&count)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	if count != len(roles) {
+		return nil, ErrUnknownRole
+	}
+	return roles, nil
+}
+
+//SetManagerRoles заменяет роли менеджера
+func (s *RBACService) SetManagerRoles(ctx context.Context, managerID int64, roles []string) ([]string, error) {
+	roles, err := s.ResolveRoles(ctx, roles)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	err = s.pool.QueryRow(ctx, `UPDATE managers SET roles = $2 WHERE id = $1 RETURNING roles`, managerID, roles).Scan(&result)
+	if err == pgx.ErrNoRows {
+		return nil, ErrNoSuchUser
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return result, nil
+}
+
+func unique(values []string) []string {
+	result := make([]string, 0, len(values))
+	seen := make(map[string]bool, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" || seen[value] {
+			continue
+		}
+		seen[value] = true
+		result = append(result, value)
+	}
+	return result
+}
+
+//roleNames приводит имена ролей к верхнему регистру, как они хранятся в roles
+func roleNames(roles []string) []string {
+	result := make([]string, 0, len(roles))
+	for _, role := range roles {
+		result = append(result, strings.ToUpper(role))
+	}
+	return unique(result)
+}
@@ -2,12 +2,11 @@ package security
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/hex"
 	"errors"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/sidalsoft/crud/pkg/security/password"
+	"log"
 	"time"
 )
 
@@ -15,62 +14,134 @@ var (
 	ErrNoSuchUser      = errors.New("no such user")
 	ErrInvalidPassword = errors.New("invalid password")
 	ErrInternal        = errors.New("internal error")
+	ErrNoSuchToken     = errors.New("no such token")
+	ErrTokenExpired    = errors.New("token expired")
+	ErrTokenRevoked    = errors.New("token revoked")
+	//ErrPhoneNotVerified пароль верный, но покупатель ещё не подтвердил номер кодом из SMS
+	ErrPhoneNotVerified = errors.New("phone not verified")
+	//ErrBasicNotAllowed менеджеру нужен второй фактор, а Basic его передать не может
+	ErrBasicNotAllowed = errors.New("basic authentication not allowed for this account")
 )
 
+//BasicConfig настройки HTTP Basic для машинных клиентов.
+//Имя пользователя - телефон менеджера, пароль - его пароль
+type BasicConfig struct {
+	Enabled bool
+	Realm   string
+}
+
+const defaultBasicRealm = "crud"
+
 //Service ..
 type AuthService struct {
 	//db *sql.DB
-	pool *pgxpool.Pool
+	pool       *pgxpool.Pool
+	sessionSvc *SessionService
+	throttle   *LoginThrottle
+	passwords  *password.Service
+	mfaSvc     *MFAService
+	blocks     *BlockService
+	basic      BasicConfig
 }
 
 //NewService ..
-func NewAuthService(pool *pgxpool.Pool) *AuthService {
-	return &AuthService{pool: pool}
+func NewAuthService(pool *pgxpool.Pool, sessionSvc *SessionService, throttle *LoginThrottle, passwords *password.Service,
+	mfaSvc *MFAService, blocks *BlockService, basic BasicConfig) *AuthService {
+	if basic.Realm == "" {
+		basic.Realm = defaultBasicRealm
+	}
+	return &AuthService{pool: pool, sessionSvc: sessionSvc, throttle: throttle, passwords: passwords,
+		mfaSvc: mfaSvc, blocks: blocks, basic: basic}
 }
 
-func (as *AuthService) Auth(login, password string) (ok bool) {
-	var item string
-
-	err := as.pool.QueryRow(context.Background(), `SELECT name FROM managers WHERE login=$1 and password=$2`,
-		login, password).Scan(&item)
+//BasicEnabled включена ли HTTP Basic аутентификация
+func (as *AuthService) BasicEnabled() bool {
+	return as.basic.Enabled
+}
 
-	if err != nil || errors.Is(err, pgx.ErrNoRows) {
-		return false
-	}
-	return true
+//BasicRealm realm для заголовка WWW-Authenticate
+func (as *AuthService) BasicRealm() string {
+	return as.basic.Realm
 }
 
-func (as *AuthService) TokenForCustomer(ctx context.Context, phone string, password string) (token string, err error) {
+//Auth проверяет телефон и пароль менеджера из HTTP Basic и возвращает его id.
+//Попытки учитываются так же, как при получении токена. Неизвестный номер проверяется
+//против фиктивного хэша, чтобы время ответа не зависело от существования номера.
+//Менеджерам с обязательным или подключённым TOTP Basic недоступен
+func (as *AuthService) Auth(ctx context.Context, phone string, pass string, client *Client) (int64, error) {
+	if err := as.throttle.Check(ctx, KindManager, phone, client); err != nil {
+		return 0, err
+	}
 	var hash string
 	var id int64
-	err = as.pool.QueryRow(ctx, `SELECT id, password FROM customers WHERE phone = $1`, phone).
+	err := as.pool.QueryRow(ctx, `SELECT id, password FROM managers WHERE phone = $1`, phone).
 		Scan(&id, &hash)
-	if err == pgx.ErrNoRows {
-		return "", ErrNoSuchUser
+	if errors.Is(err, pgx.ErrNoRows) {
+		as.passwords.CompareDummy(pass)
+		as.throttle.Fail(ctx, KindManager, phone, client)
+		return 0, ErrNoSuchUser
 	}
 	if err != nil {
-		return "", ErrInternal
+		log.Println(err)
+		return 0, ErrInternal
+	}
+
+	if !as.passwords.Compare(hash, pass) {
+		as.throttle.Fail(ctx, KindManager, phone, client)
+		return 0, ErrInvalidPassword
+	}
+	as.throttle.Succeed(ctx, KindManager, phone, client)
+	as.passwords.Rehash(ctx, KindManager, id, pass, hash)
+	if err := as.blocks.Check(ctx, KindManager, id); err != nil {
+		return 0, err
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	needed, err := as.mfaSvc.Needed(ctx, id)
 	if err != nil {
-		return "", ErrInvalidPassword
+		return 0, err
 	}
-	buffer := make([]byte, 256)
-	n, err := rand.Read(buffer)
-	if n != len(buffer) || err != nil {
-		return "", ErrInternal
+	if needed {
+		return 0, ErrBasicNotAllowed
+	}
+	return id, nil
+}
+
+func (as *AuthService) TokenForCustomer(ctx context.Context, phone string, pass string, client *Client) (*TokenPair, error) {
+	if err := as.throttle.Check(ctx, KindCustomer, phone, client); err != nil {
+		return nil, err
+	}
+	var hash string
+	var id int64
+	var verified bool
+	err := as.pool.QueryRow(ctx, `SELECT id, password, phone_verified FROM customers WHERE phone = $1 AND deleted IS NULL`, phone).
+		Scan(&id, &hash, &verified)
+	if err == pgx.ErrNoRows {
+		as.passwords.CompareDummy(pass)
+		as.throttle.Fail(ctx, KindCustomer, phone, client)
+		return nil, ErrNoSuchUser
 	}
-	token = hex.EncodeToString(buffer)
-	_, err = as.pool.Exec(ctx, `INSERT INTO customers_tokens(token, customer_id) VALUES($1,$2)`, token, id)
 	if err != nil {
-		return "", ErrInternal
+		return nil, ErrInternal
+	}
+
+	if !as.passwords.Compare(hash, pass) {
+		as.throttle.Fail(ctx, KindCustomer, phone, client)
+		return nil, ErrInvalidPassword
+	}
+	as.throttle.Succeed(ctx, KindCustomer, phone, client)
+	as.passwords.Rehash(ctx, KindCustomer, id, pass, hash)
+	//о блокировке сообщается только после верного пароля, чтобы не раскрывать её посторонним
+	if err := as.blocks.Check(ctx, KindCustomer, id); err != nil {
+		return nil, err
+	}
+	if !verified {
+		return nil, ErrPhoneNotVerified
 	}
-	return token, nil
+	return as.sessionSvc.Create(ctx, KindCustomer, id, client)
 }
 
 func (as *AuthService) AuthenticateCustomer(ctx context.Context, token string) (id int64, expire *time.Time, err error) {
-	err = as.pool.QueryRow(ctx, `SELECT customer_id, expire FROM customers_tokens WHERE token = $1`, token).Scan(&id, &expire)
+	err = as.pool.QueryRow(ctx, `SELECT customer_id, expire FROM customers_tokens WHERE token_hash = $1`, as.sessionSvc.Digest(token)).Scan(&id, &expire)
 
 	if err == pgx.ErrNoRows {
 		return 0, nil, ErrNoSuchUser
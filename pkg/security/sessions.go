@@ -0,0 +1,592 @@
+package security
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"log"
+	"strconv"
+	"time"
+)
+
+//Типы пользователей, для которых выдаются токены
+const (
+	KindManager  = "manager"
+	KindCustomer = "customer"
+)
+
+//ErrUnknownKind ...
+var ErrUnknownKind = errors.New("unknown principal kind")
+
+//ErrNoSuchSession ...
+var ErrNoSuchSession = errors.New("no such session")
+
+//ErrTokenReused повторное использование уже обменянного refresh-токена.
+//Семейство токенов при этом отзывается целиком
+var ErrTokenReused = errors.New("refresh token reused")
+
+type tokenTable struct {
+	name  string
+	owner string
+}
+
+var tokenTables = map[string]tokenTable{
+	KindManager:  {name: "managers_tokens", owner: "managers_id"},
+	KindCustomer: {name: "customers_tokens", owner: "customer_id"},
+}
+
+//TokenTTL время жизни токенов одного типа пользователей
+type TokenTTL struct {
+	Access  time.Duration
+	Refresh time.Duration
+}
+
+//SessionConfig настройки выдачи токенов по типам пользователей.
+//Если задан Pepper, в базе хранится HMAC-SHA256 токена с этим ключом, иначе SHA-256
+type SessionConfig struct {
+	TTL    map[string]TokenTTL
+	Pepper string
+}
+
+//Client описывает устройство, с которого пришёл запрос
+type Client struct {
+	IP        string
+	UserAgent string
+}
+
+//TokenPair короткоживущий access-токен и долгоживущий refresh-токен
+type TokenPair struct {
+	Token        string    `json:"token"`
+	Expire       time.Time `json:"expire"`
+	RefreshToken string    `json:"refreshToken"`
+	RefreshUntil time.Time `json:"refreshExpire"`
+}
+
+//Session ...
+type Session struct {
+	ID        int64      `json:"id"`
+	IP        string     `json:"ip"`
+	UserAgent string     `json:"userAgent"`
+	LastUsed  *time.Time `json:"lastUsed"`
+	Expire    time.Time  `json:"expire"`
+	Created   time.Time  `json:"created"`
+}
+
+//SessionService управляет токенами менеджеров и покупателей
+type SessionService struct {
+	pool   *pgxpool.Pool
+	config SessionConfig
+	jwtSvc *JWTService
+}
+
+//NewSessionService ..
+func NewSessionService(pool *pgxpool.Pool, config SessionConfig, jwtSvc *JWTService) *SessionService {
+	return &SessionService{pool: pool, config: config, jwtSvc: jwtSvc}
+}
+
+func tableFor(kind string) (tokenTable, error) {
+	table, ok := tokenTables[kind]
+	if !ok {
+		return tokenTable{}, ErrUnknownKind
+	}
+	return table, nil
+}
+
+//jwtAccessTTL наибольший срок подписанного access-токена: отзыв JWT виден только
+//экземпляру сервера, который его отозвал, остальные узнают о нём по истечении срока
+const jwtAccessTTL = 15 * time.Minute
+
+func (s *SessionService) ttlFor(kind string) TokenTTL {
+	ttl := s.config.TTL[kind]
+	if ttl.Access <= 0 {
+		ttl.Access = time.Hour
+	}
+	if s.jwtSvc.Enabled() && ttl.Access > jwtAccessTTL {
+		ttl.Access = jwtAccessTTL
+	}
+	if ttl.Refresh <= 0 {
+		ttl.Refresh = 30 * 24 * time.Hour
+	}
+	return ttl
+}
+
+func randomHex(size int) (string, error) {
+	buffer := make([]byte, size)
+	n, err := rand.Read(buffer)
+	if n != len(buffer) || err != nil {
+		return "", ErrInternal
+	}
+	return hex.EncodeToString(buffer), nil
+}
+
+//Digest возвращает отпечаток токена, который хранится в базе вместо самого токена
+func (s *SessionService) Digest(token string) string {
+	if s.config.Pepper == "" {
+		sum := sha256.Sum256([]byte(token))
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, []byte(s.config.Pepper))
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//Create начинает новую сессию: выпускает пару токенов нового семейства
+func (s *SessionService) Create(ctx context.Context, kind string, ownerID int64, client *Client) (*TokenPair, error) {
+	if _, err := tableFor(kind); err != nil {
+		return nil, err
+	}
+	family, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			log.Println(err)
+		}
+	}()
+
+	pair, err := s.issue(ctx, tx, kind, ownerID, family, client)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return pair, nil
+}
+
+//issue сохраняет access- и refresh-токен в рамках семейства
+func (s *SessionService) issue(ctx context.Context, tx pgx.Tx, kind string, ownerID int64, family string, client *Client) (*TokenPair, error) {
+	table, err := tableFor(kind)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		client = &Client{}
+	}
+	ttl := s.ttlFor(kind)
+	pair := &TokenPair{}
+
+	var jti *string
+	if s.jwtSvc.Enabled() {
+		var id string
+		pair.Token, id, err = s.signAccessToken(ctx, tx, kind, ownerID, ttl.Access)
+		jti = &id
+	} else {
+		pair.Token, err = randomHex(256)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(ctx, `
+INSERT INTO `+table.name+`(token_hash, `+table.owner+`, family, ip, user_agent, expire, jti)
+VALUES($1, $2, $3, $4, $5, CURRENT_TIMESTAMP + make_interval(secs => $6), $7)
+RETURNING expire`,
+		s.Digest(pair.Token), ownerID, family, client.IP, client.UserAgent, ttl.Access.Seconds(), jti).Scan(&pair.Expire)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+
+	pair.RefreshToken, err = randomHex(256)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(ctx, `
+INSERT INTO refresh_tokens(token_hash, kind, owner_id, family, expire)
+VALUES($1, $2, $3, $4, CURRENT_TIMESTAMP + make_interval(secs => $5))
+RETURNING expire`,
+		s.Digest(pair.RefreshToken), kind, ownerID, family, ttl.Refresh.Seconds()).Scan(&pair.RefreshUntil)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return pair, nil
+}
+
+//signAccessToken выпускает JWT и возвращает его jti. Токен сохраняется в таблице сессий вместе с jti,
+//чтобы сессию было видно в списке, а при отзыве jti попал в список отозванных JWTService.
+//Роли в токене - для внешних сервисов, сам сервер права по ним не выдаёт
+func (s *SessionService) signAccessToken(ctx context.Context, tx pgx.Tx, kind string, ownerID int64, ttl time.Duration) (string, string, error) {
+	var roles []string
+	if kind == KindManager {
+		err := tx.QueryRow(ctx, `SELECT roles FROM managers WHERE id = $1`, ownerID).Scan(&roles)
+		if err != nil {
+			log.Println(err)
+			return "", "", ErrInternal
+		}
+	}
+	id, err := randomHex(16)
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	token, err := s.jwtSvc.Sign(&Claims{
+		ID:       id,
+		Subject:  strconv.FormatInt(ownerID, 10),
+		Kind:     kind,
+		Roles:    roles,
+		IssuedAt: now.Unix(),
+		Expire:   now.Add(ttl).Unix(),
+	})
+	if err != nil {
+		log.Println(err)
+		return "", "", ErrInternal
+	}
+	return token, id, nil
+}
+
+//refreshState refresh-токен и его владелец на момент обмена
+type refreshState struct {
+	rotated bool
+	revoked bool
+	expired bool
+	exists  bool
+	active  bool
+	blocked *BlockedError
+}
+
+//check решает, можно ли обменять токен. ErrTokenReused означает, что семейство нужно отозвать.
+//Удалённый владелец - ErrNoSuchUser, заблокированный - *BlockedError
+func (r *refreshState) check() error {
+	switch {
+	case r.revoked:
+		return ErrTokenRevoked
+	case r.rotated:
+		return ErrTokenReused
+	case r.expired:
+		return ErrTokenExpired
+	case !r.exists:
+		return ErrNoSuchUser
+	case !r.active:
+		return r.blocked
+	}
+	return nil
+}
+
+//Refresh обменивает refresh-токен на новую пару. Каждый refresh-токен одноразовый:
+//повторное предъявление уже обменянного токена отзывает всё семейство.
+//Удалённый или заблокированный пользователь не получит новую пару, даже если его токены не были отозваны
+func (s *SessionService) Refresh(ctx context.Context, kind string, refreshToken string, client *Client) (*TokenPair, error) {
+	if _, err := tableFor(kind); err != nil {
+		return nil, err
+	}
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			log.Println(err)
+		}
+	}()
+
+	var id, ownerID int64
+	var family string
+	state := &refreshState{blocked: &BlockedError{}}
+	err = tx.QueryRow(ctx, `
+SELECT r.id, r.owner_id, r.family, r.rotated IS NOT NULL, r.revoked IS NOT NULL, r.expire < CURRENT_TIMESTAMP,
+       a.id IS NOT NULL, COALESCE(`+ActiveCondition("a.")+`, FALSE), COALESCE(a.blocked_reason, ''), a.blocked_until
+FROM refresh_tokens r LEFT JOIN `+accountTables[kind]+` a ON a.id = r.owner_id`+accountScopes[kind]+`
+WHERE r.token_hash = $1 AND r.kind = $2 FOR UPDATE OF r`, s.Digest(refreshToken), kind).
+		Scan(&id, &ownerID, &family, &state.rotated, &state.revoked, &state.expired,
+			&state.exists, &state.active, &state.blocked.Reason, &state.blocked.Until)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNoSuchToken
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	err = state.check()
+	if errors.Is(err, ErrTokenReused) {
+		if err := s.revokeFamily(ctx, tx, kind, family); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			log.Println(err)
+			return nil, ErrInternal
+		}
+		return nil, ErrTokenReused
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE refresh_tokens SET rotated = CURRENT_TIMESTAMP WHERE id = $1`, id)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	pair, err := s.issue(ctx, tx, kind, ownerID, family, client)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return pair, nil
+}
+
+//revokeFamily отзывает все access- и refresh-токены семейства
+func (s *SessionService) revokeFamily(ctx context.Context, tx pgx.Tx, kind string, family string) error {
+	table, err := tableFor(kind)
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query(ctx, `
+UPDATE `+table.name+` SET revoked = CURRENT_TIMESTAMP WHERE family = $1 AND revoked IS NULL RETURNING jti`, family)
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	if _, err := s.denyJWT(kind, rows); err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+UPDATE refresh_tokens SET revoked = CURRENT_TIMESTAMP WHERE family = $1 AND kind = $2 AND revoked IS NULL`, family, kind)
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	return nil
+}
+
+//OwnerByToken возвращает владельца действующего токена и отмечает время последнего использования.
+//Токен, отозванность и блокировка владельца проверяются одним запросом, поэтому
+//проверка на каждом запросе не стоит второго обращения к базе
+func (s *SessionService) OwnerByToken(ctx context.Context, kind string, token string) (int64, error) {
+	table, err := tableFor(kind)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	var expired, revoked, active bool
+	blocked := &BlockedError{}
+	err = s.pool.QueryRow(ctx, `
+UPDATE `+table.name+` t SET last_used = CURRENT_TIMESTAMP FROM `+accountTables[kind]+` a
+WHERE t.token_hash = $1 AND a.id = t.`+table.owner+accountScopes[kind]+`
+RETURNING t.`+table.owner+`, t.expire < CURRENT_TIMESTAMP, t.revoked IS NOT NULL, `+ActiveCondition("a.")+`,
+          a.blocked_reason, a.blocked_until`, s.Digest(token)).
+		Scan(&id, &expired, &revoked, &active, &blocked.Reason, &blocked.Until)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrNoSuchToken
+	}
+	if err != nil {
+		log.Println(err)
+		return 0, ErrInternal
+	}
+	if revoked {
+		return 0, ErrTokenRevoked
+	}
+	if expired {
+		return 0, ErrTokenExpired
+	}
+	if !active {
+		return 0, blocked
+	}
+	return id, nil
+}
+
+//List возвращает действующие сессии пользователя: по одной записи на семейство,
+//пока жив access-токен или ещё можно обменять refresh-токен
+func (s *SessionService) List(ctx context.Context, kind string, ownerID int64) ([]*Session, error) {
+	table, err := tableFor(kind)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.pool.Query(ctx, `
+SELECT DISTINCT ON (t.family) t.id, t.ip, t.user_agent, t.last_used, t.expire, t.created
+FROM `+table.name+` t
+WHERE t.`+table.owner+` = $1 AND t.revoked IS NULL
+  AND (t.expire > CURRENT_TIMESTAMP OR EXISTS(
+    SELECT 1 FROM refresh_tokens r
+    WHERE r.family = t.family AND r.kind = $2 AND r.rotated IS NULL AND r.revoked IS NULL
+      AND r.expire > CURRENT_TIMESTAMP))
+ORDER BY t.family, t.created DESC`, ownerID, kind)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	defer rows.Close()
+
+	items := make([]*Session, 0)
+	for rows.Next() {
+		item := &Session{}
+		err := rows.Scan(
+			&item.ID,
+			&item.IP,
+			&item.UserAgent,
+			&item.LastUsed,
+			&item.Expire,
+			&item.Created,
+		)
+		if err != nil {
+			log.Println(err)
+			return nil, ErrInternal
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return items, nil
+}
+
+//Revoke отзывает одну сессию пользователя вместе с её refresh-токенами
+func (s *SessionService) Revoke(ctx context.Context, kind string, ownerID int64, sessionID int64) error {
+	table, err := tableFor(kind)
+	if err != nil {
+		return err
+	}
+	return s.revokeWhere(ctx, kind, `id = $1 AND `+table.owner+` = $2`, sessionID, ownerID)
+}
+
+//RevokeToken отзывает сессию по токену (logout)
+func (s *SessionService) RevokeToken(ctx context.Context, kind string, token string) error {
+	return s.revokeWhere(ctx, kind, `token_hash = $1`, s.Digest(token))
+}
+
+func (s *SessionService) revokeWhere(ctx context.Context, kind string, where string, args ...interface{}) error {
+	table, err := tableFor(kind)
+	if err != nil {
+		return err
+	}
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			log.Println(err)
+		}
+	}()
+
+	var family string
+	err = tx.QueryRow(ctx, `SELECT family FROM `+table.name+` WHERE `+where+` AND revoked IS NULL`, args...).Scan(&family)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNoSuchSession
+	}
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	if err := s.revokeFamily(ctx, tx, kind, family); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	return nil
+}
+
+//RevokeAll отзывает все сессии пользователя и возвращает количество отозванных токенов
+func (s *SessionService) RevokeAll(ctx context.Context, kind string, ownerID int64) (int64, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		log.Println(err)
+		return 0, ErrInternal
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			log.Println(err)
+		}
+	}()
+
+	revoked, err := s.RevokeAllTx(ctx, tx, kind, ownerID)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Println(err)
+		return 0, ErrInternal
+	}
+	return revoked, nil
+}
+
+//RevokeAllTx отзывает все access- и refresh-токены пользователя в транзакции вызывающего
+func (s *SessionService) RevokeAllTx(ctx context.Context, tx pgx.Tx, kind string, ownerID int64) (int64, error) {
+	table, err := tableFor(kind)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := tx.Query(ctx, `
+UPDATE `+table.name+` SET revoked = CURRENT_TIMESTAMP WHERE `+table.owner+` = $1 AND revoked IS NULL RETURNING jti`, ownerID)
+	if err != nil {
+		log.Println(err)
+		return 0, ErrInternal
+	}
+	revoked, err := s.denyJWT(kind, rows)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(ctx, `
+UPDATE refresh_tokens SET revoked = CURRENT_TIMESTAMP WHERE owner_id = $1 AND kind = $2 AND revoked IS NULL`, ownerID, kind)
+	if err != nil {
+		log.Println(err)
+		return 0, ErrInternal
+	}
+	return revoked, nil
+}
+
+//denyJWT заносит jti отозванных access-токенов из RETURNING jti в список отозванных JWTService
+//и возвращает количество отозванных токенов. Список пополняется до фиксации транзакции:
+//если она откатится, подписанный токен лишь раньше срока перестанет приниматься
+func (s *SessionService) denyJWT(kind string, rows pgx.Rows) (int64, error) {
+	defer rows.Close()
+	until := time.Now().Add(s.ttlFor(kind).Access)
+	var count int64
+	for rows.Next() {
+		var jti *string
+		if err := rows.Scan(&jti); err != nil {
+			log.Println(err)
+			return 0, ErrInternal
+		}
+		count++
+		if jti != nil {
+			s.jwtSvc.Revoke(*jti, until)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return 0, ErrInternal
+	}
+	return count, nil
+}
+
+//LoadRevokedJWT восстанавливает список отозванных JWT после перезапуска: в него попадают
+//jti отозванных, но ещё не истёкших access-токенов
+func (s *SessionService) LoadRevokedJWT(ctx context.Context) error {
+	if !s.jwtSvc.Enabled() {
+		return nil
+	}
+	for kind, table := range tokenTables {
+		rows, err := s.pool.Query(ctx, `
+SELECT jti FROM `+table.name+` WHERE jti IS NOT NULL AND revoked IS NOT NULL AND expire > CURRENT_TIMESTAMP`)
+		if err != nil {
+			log.Println(err)
+			return ErrInternal
+		}
+		if _, err := s.denyJWT(kind, rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
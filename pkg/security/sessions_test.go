@@ -0,0 +1,30 @@
+package security
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRefreshStateCheck(t *testing.T) {
+	blocked := &BlockedError{Reason: "fraud"}
+	tests := []struct {
+		name  string
+		state refreshState
+		err   error
+	}{
+		{name: "valid", state: refreshState{exists: true, active: true}},
+		{name: "revoked", state: refreshState{revoked: true, rotated: true, exists: true, active: true}, err: ErrTokenRevoked},
+		{name: "reused", state: refreshState{rotated: true, expired: true, exists: true, active: true}, err: ErrTokenReused},
+		{name: "reused by deleted owner", state: refreshState{rotated: true}, err: ErrTokenReused},
+		{name: "expired", state: refreshState{expired: true, exists: true, active: true}, err: ErrTokenExpired},
+		{name: "soft-deleted owner", state: refreshState{blocked: blocked}, err: ErrNoSuchUser},
+		{name: "blocked owner", state: refreshState{exists: true, blocked: blocked}, err: blocked},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.state.check(); !errors.Is(err, test.err) {
+				t.Errorf("check() = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package security
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"log"
+	"math"
+	"time"
+)
+
+//ThrottleConfig настройки защиты от перебора паролей.
+//После MaxFailures неудачных попыток за Window вход блокируется на BaseLockout,
+//каждая следующая неудача удваивает блокировку, но не больше MaxLockout
+type ThrottleConfig struct {
+	MaxFailures   int
+	MaxIPFailures int
+	Window        time.Duration
+	BaseLockout   time.Duration
+	MaxLockout    time.Duration
+}
+
+//LockedError вход временно заблокирован
+type LockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("login locked, retry after %s", e.RetryAfter)
+}
+
+//Lockout ...
+type Lockout struct {
+	ID       int64     `json:"id"`
+	Kind     string    `json:"kind"`
+	Scope    string    `json:"scope"`
+	Value    string    `json:"value"`
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until"`
+	Created  time.Time `json:"created"`
+}
+
+//LockoutFilter ...
+type LockoutFilter struct {
+	Kind   string
+	Value  string
+	Active bool
+	Limit  int
+	Offset int
+}
+
+//LoginThrottle учитывает попытки входа по номеру телефона и по IP
+type LoginThrottle struct {
+	pool   *pgxpool.Pool
+	config ThrottleConfig
+}
+
+//NewLoginThrottle ..
+func NewLoginThrottle(pool *pgxpool.Pool, config ThrottleConfig) *LoginThrottle {
+	if config.MaxFailures <= 0 {
+		config.MaxFailures = 5
+	}
+	if config.MaxIPFailures <= 0 {
+		config.MaxIPFailures = 4 * config.MaxFailures
+	}
+	if config.Window <= 0 {
+		config.Window = 15 * time.Minute
+	}
+	if config.BaseLockout <= 0 {
+		config.BaseLockout = time.Minute
+	}
+	if config.MaxLockout <= 0 {
+		config.MaxLockout = 24 * time.Hour
+	}
+	return &LoginThrottle{pool: pool, config: config}
+}
+
+//Check возвращает *LockedError, если номер или IP сейчас заблокированы
+func (t *LoginThrottle) Check(ctx context.Context, kind string, phone string, client *Client) error {
+	ip := ""
+	if client != nil {
+		ip = client.IP
+	}
+	var seconds *float64
+	err := t.pool.QueryRow(ctx, `
+SELECT EXTRACT(EPOCH FROM max(until) - CURRENT_TIMESTAMP)::float8 FROM lockouts
+WHERE kind = $1 AND until > CURRENT_TIMESTAMP
+  AND ((scope = 'phone' AND value = $2) OR (scope = 'ip' AND value = $3 AND $3 <> ''))`, kind, phone, ip).Scan(&seconds)
+	if err != nil {
+		log.Println(err)
+		return ErrInternal
+	}
+	if seconds != nil {
+		return &LockedError{RetryAfter: time.Duration(math.Ceil(*seconds)) * time.Second}
+	}
+	return nil
+}
+
+//Succeed записывает успешный вход, счётчик неудач по номеру после этого начинается заново
+func (t *LoginThrottle) Succeed(ctx context.Context, kind string, phone string, client *Client) {
+	t.record(ctx, kind, phone, client, true)
+}
+
+//Fail записывает неудачную попытку и при превышении порога блокирует номер или IP
+func (t *LoginThrottle) Fail(ctx context.Context, kind string, phone string, client *Client) {
+	t.record(ctx, kind, phone, client, false)
+
+	var phoneFailures int
+	err := t.pool.QueryRow(ctx, `
+SELECT count(*) FROM login_attempts
+WHERE kind = $1 AND phone = $2 AND NOT success
+  AND created > GREATEST(CURRENT_TIMESTAMP - make_interval(secs => $3), (
+    SELECT max(created) FROM login_attempts WHERE kind = $1 AND phone = $2 AND success))`,
+		kind, phone, t.config.Window.Seconds()).Scan(&phoneFailures)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	t.lock(ctx, kind, "phone", phone, phoneFailures, t.config.MaxFailures)
+
+	if client == nil || client.IP == "" {
+		return
+	}
+	var ipFailures int
+	err = t.pool.QueryRow(ctx, `
+SELECT count(*) FROM login_attempts
+WHERE kind = $1 AND ip = $2 AND NOT success AND created > CURRENT_TIMESTAMP - make_interval(secs => $3)`,
+		kind, client.IP, t.config.Window.Seconds()).Scan(&ipFailures)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	t.lock(ctx, kind, "ip", client.IP, ipFailures, t.config.MaxIPFailures)
+}
+
+func (t *LoginThrottle) record(ctx context.Context, kind string, phone string, client *Client, success bool) {
+	ip := ""
+	if client != nil {
+		ip = client.IP
+	}
+	_, err := t.pool.Exec(ctx, `
+INSERT INTO login_attempts(kind, phone, ip, success) VALUES($1, $2, $3, $4)`, kind, phone, ip, success)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (t *LoginThrottle) lock(ctx context.Context, kind string, scope string, value string, failures int, max int) {
+	if failures < max {
+		return
+	}
+	duration := lockoutDuration(t.config, failures, max)
+	_, err := t.pool.Exec(ctx, `
+INSERT INTO lockouts(kind, scope, value, failures, until)
+VALUES($1, $2, $3, $4, CURRENT_TIMESTAMP + make_interval(secs => $5))`, kind, scope, value, failures, duration.Seconds())
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+//lockoutDuration срок блокировки после failures неудач при пороге max:
+//BaseLockout на пороге, дальше удвоение за каждую неудачу, но не больше MaxLockout
+func lockoutDuration(config ThrottleConfig, failures int, max int) time.Duration {
+	duration := config.BaseLockout
+	for i := max; i < failures && duration < config.MaxLockout; i++ {
+		duration *= 2
+	}
+	if duration > config.MaxLockout {
+		duration = config.MaxLockout
+	}
+	return duration
+}
+
+//Lockouts возвращает блокировки для администратора, новые первыми
+func (t *LoginThrottle) Lockouts(ctx context.Context, filter *LockoutFilter) ([]*Lockout, error) {
+	if filter.Limit <= 0 || filter.Limit > 500 {
+		filter.Limit = 50
+	}
+	rows, err := t.pool.Query(ctx, `
+SELECT id, kind, scope, value, failures, until, created FROM lockouts
+WHERE ($1 = '' OR kind = $1) AND ($2 = '' OR value = $2) AND (NOT $3 OR until > CURRENT_TIMESTAMP)
+ORDER BY created DESC LIMIT $4 OFFSET $5`, filter.Kind, filter.Value, filter.Active, filter.Limit, filter.Offset)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	defer rows.Close()
+
+	items := make([]*Lockout, 0)
+	for rows.Next() {
+		item := &Lockout{}
+		err := rows.Scan(
+			&item.ID,
+			&item.Kind,
+			&item.Scope,
+			&item.Value,
+			&item.Failures,
+			&item.Until,
+			&item.Created,
+		)
+		if err != nil {
+			log.Println(err)
+			return nil, ErrInternal
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return nil, ErrInternal
+	}
+	return items, nil
+}
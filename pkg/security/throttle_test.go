@@ -0,0 +1,46 @@
+package security
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	config := ThrottleConfig{BaseLockout: time.Minute, MaxLockout: 10 * time.Minute}
+	tests := []struct {
+		name     string
+		config   ThrottleConfig
+		failures int
+		max      int
+		want     time.Duration
+	}{
+		{name: "at threshold", config: config, failures: 5, max: 5, want: time.Minute},
+		{name: "one over", config: config, failures: 6, max: 5, want: 2 * time.Minute},
+		{name: "three over", config: config, failures: 8, max: 5, want: 8 * time.Minute},
+		{name: "capped", config: config, failures: 9, max: 5, want: 10 * time.Minute},
+		{name: "far over stays capped", config: config, failures: 500, max: 5, want: 10 * time.Minute},
+		{name: "base above cap", config: ThrottleConfig{BaseLockout: time.Hour, MaxLockout: time.Minute}, failures: 5, max: 5, want: time.Minute},
+		{name: "ip threshold", config: config, failures: 21, max: 20, want: 2 * time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := lockoutDuration(test.config, test.failures, test.max); got != test.want {
+				t.Errorf("lockoutDuration() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewLoginThrottleDefaults(t *testing.T) {
+	throttle := NewLoginThrottle(nil, ThrottleConfig{MaxFailures: 3})
+	want := ThrottleConfig{
+		MaxFailures:   3,
+		MaxIPFailures: 12,
+		Window:        15 * time.Minute,
+		BaseLockout:   time.Minute,
+		MaxLockout:    24 * time.Hour,
+	}
+	if throttle.config != want {
+		t.Errorf("config = %+v, want %+v", throttle.config, want)
+	}
+}
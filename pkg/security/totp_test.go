@@ -0,0 +1,80 @@
+package security
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+//rfc6238Secret секрет "12345678901234567890" из тестовых векторов RFC 6238 в base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestValidateTOTP(t *testing.T) {
+	at := time.Unix(1111111109, 0)
+	step := totpStep(at)
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		now      time.Time
+		lastStep int64
+		step     int64
+		ok       bool
+	}{
+		{name: "rfc 6238 vector", secret: rfc6238Secret, code: "081804", now: at, step: step, ok: true},
+		{name: "rfc 6238 vector 59", secret: rfc6238Secret, code: "287082", now: time.Unix(59, 0), step: 1, ok: true},
+		{name: "rfc 6238 vector 1234567890", secret: rfc6238Secret, code: "005924", now: time.Unix(1234567890, 0), step: totpStep(time.Unix(1234567890, 0)), ok: true},
+		{name: "lowercase secret and spaces", secret: " gezdgnbvgy3tqojqgezdgnbvgy3tqojq ", code: " 081804 ", now: at, step: step, ok: true},
+		{name: "previous period within skew", secret: rfc6238Secret, code: "081804", now: at.Add(totpPeriod * time.Second), step: step, ok: true},
+		{name: "next period within skew", secret: rfc6238Secret, code: "081804", now: at.Add(-totpPeriod * time.Second), step: step, ok: true},
+		{name: "outside skew", secret: rfc6238Secret, code: "081804", now: at.Add(2 * totpPeriod * time.Second)},
+		{name: "replay of used step", secret: rfc6238Secret, code: "081804", now: at, lastStep: step},
+		{name: "replay of later step", secret: rfc6238Secret, code: "081804", now: at, lastStep: step + 1},
+		{name: "step after last used", secret: rfc6238Secret, code: "081804", now: at, lastStep: step - 1, step: step, ok: true},
+		{name: "wrong code", secret: rfc6238Secret, code: "081805", now: at},
+		{name: "short code", secret: rfc6238Secret, code: "81804", now: at},
+		{name: "long code", secret: rfc6238Secret, code: "0081804", now: at},
+		{name: "invalid secret", secret: "not base32!", code: "081804", now: at},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			step, ok := ValidateTOTP(test.secret, test.code, test.now, test.lastStep)
+			if ok != test.ok || step != test.step {
+				t.Errorf("ValidateTOTP() = %d, %v, want %d, %v", step, ok, test.step, test.ok)
+			}
+		})
+	}
+}
+
+func TestNewTOTPSecret(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(key) != 20 {
+		t.Fatalf("secret %q decodes to %d bytes, err %v", secret, len(key), err)
+	}
+	code := totpCode(key, totpStep(time.Now()))
+	if _, ok := ValidateTOTP(secret, code, time.Now(), 0); !ok {
+		t.Errorf("code %s for a new secret is rejected", code)
+	}
+}
+
+func TestRecoveryCode(t *testing.T) {
+	format := regexp.MustCompile(`^[0-9a-f]{5}(-[0-9a-f]{5}){3}$`)
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		code, err := recoveryCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !format.MatchString(code) {
+			t.Fatalf("recoveryCode() = %q, want 80 bits as xxxxx-xxxxx-xxxxx-xxxxx", code)
+		}
+		if seen[code] {
+			t.Fatalf("recoveryCode() repeated %q", code)
+		}
+		seen[code] = true
+	}
+}
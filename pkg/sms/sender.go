@@ -0,0 +1,57 @@
+package sms
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+//Sender отправляет SMS. Реализация для настоящего шлюза подключается в cmd/main.go
+type Sender interface {
+	Send(ctx context.Context, phone string, text string) error
+}
+
+//LogSender пишет сообщения в лог вместо отправки, для локальной разработки
+type LogSender struct{}
+
+//NewLogSender ..
+func NewLogSender() *LogSender {
+	return &LogSender{}
+}
+
+//Send ...
+func (s *LogSender) Send(ctx context.Context, phone string, text string) error {
+	log.Printf("sms to %s: %s", phone, text)
+	return nil
+}
+
+//FileSender дописывает сообщения в файл, чтобы их можно было читать в тестовом окружении
+type FileSender struct {
+	mu   sync.Mutex
+	path string
+}
+
+//NewFileSender ..
+func NewFileSender(path string) *FileSender {
+	return &FileSender{path: path}
+}
+
+//Send ...
+func (s *FileSender) Send(ctx context.Context, phone string, text string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(file, "%s\t%s\t%s\n", time.Now().Format(time.RFC3339), phone, text)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
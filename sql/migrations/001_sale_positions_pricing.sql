@@ -0,0 +1,6 @@
+ALTER TABLE sale_positions
+    ADD COLUMN list_price        INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN price_override_by BIGINT REFERENCES managers;
+
+UPDATE sale_positions
+SET list_price = price;
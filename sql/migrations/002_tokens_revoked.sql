@@ -0,0 +1,5 @@
+ALTER TABLE customers_tokens
+    ADD COLUMN revoked TIMESTAMP;
+
+ALTER TABLE managers_tokens
+    ADD COLUMN revoked TIMESTAMP;
@@ -0,0 +1,11 @@
+ALTER TABLE customers_tokens
+    ADD COLUMN id         BIGSERIAL PRIMARY KEY,
+    ADD COLUMN last_used  TIMESTAMP,
+    ADD COLUMN ip         TEXT NOT NULL DEFAULT '',
+    ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE managers_tokens
+    ADD COLUMN id         BIGSERIAL PRIMARY KEY,
+    ADD COLUMN last_used  TIMESTAMP,
+    ADD COLUMN ip         TEXT NOT NULL DEFAULT '',
+    ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,28 @@
+ALTER TABLE customers_tokens
+    ADD COLUMN family TEXT;
+UPDATE customers_tokens
+SET family = 'legacy-' || id;
+ALTER TABLE customers_tokens
+    ALTER COLUMN family SET NOT NULL;
+
+ALTER TABLE managers_tokens
+    ADD COLUMN family TEXT;
+UPDATE managers_tokens
+SET family = 'legacy-' || id;
+ALTER TABLE managers_tokens
+    ALTER COLUMN family SET NOT NULL;
+
+CREATE TABLE refresh_tokens
+(
+    id       BIGSERIAL PRIMARY KEY,
+    token    TEXT      NOT NULL UNIQUE,
+    kind     TEXT      NOT NULL,
+    owner_id BIGINT    NOT NULL,
+    family   TEXT      NOT NULL,
+    expire   TIMESTAMP NOT NULL,
+    rotated  TIMESTAMP,
+    revoked  TIMESTAMP,
+    created  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX refresh_tokens_family_idx ON refresh_tokens (family);
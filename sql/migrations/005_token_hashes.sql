@@ -0,0 +1,21 @@
+-- Токены хранятся в виде SHA-256. Уже выданные токены переводятся в отпечатки на месте,
+-- поэтому пользователи остаются в системе.
+-- Если сервер запущен с TOKEN_PEPPER, вместо sha256(...) нужен HMAC (расширение pgcrypto):
+--   encode(hmac(token_hash, :'pepper', 'sha256'), 'hex')
+ALTER TABLE customers_tokens
+    RENAME COLUMN token TO token_hash;
+UPDATE customers_tokens
+SET token_hash = encode(sha256(convert_to(token_hash, 'UTF8')), 'hex')
+WHERE token_hash !~ '^[0-9a-f]{64}$';
+
+ALTER TABLE managers_tokens
+    RENAME COLUMN token TO token_hash;
+UPDATE managers_tokens
+SET token_hash = encode(sha256(convert_to(token_hash, 'UTF8')), 'hex')
+WHERE token_hash !~ '^[0-9a-f]{64}$';
+
+ALTER TABLE refresh_tokens
+    RENAME COLUMN token TO token_hash;
+UPDATE refresh_tokens
+SET token_hash = encode(sha256(convert_to(token_hash, 'UTF8')), 'hex')
+WHERE token_hash !~ '^[0-9a-f]{64}$';
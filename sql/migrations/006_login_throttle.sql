@@ -0,0 +1,25 @@
+CREATE TABLE login_attempts
+(
+    id      BIGSERIAL PRIMARY KEY,
+    kind    TEXT      NOT NULL,
+    phone   TEXT      NOT NULL,
+    ip      TEXT      NOT NULL DEFAULT '',
+    success BOOLEAN   NOT NULL,
+    created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX login_attempts_phone_idx ON login_attempts (kind, phone, created);
+CREATE INDEX login_attempts_ip_idx ON login_attempts (kind, ip, created);
+
+CREATE TABLE lockouts
+(
+    id       BIGSERIAL PRIMARY KEY,
+    kind     TEXT      NOT NULL,
+    scope    TEXT      NOT NULL CHECK ( scope IN ('phone', 'ip') ),
+    value    TEXT      NOT NULL,
+    failures INTEGER   NOT NULL,
+    until    TIMESTAMP NOT NULL,
+    created  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX lockouts_value_idx ON lockouts (kind, scope, value, until);
@@ -0,0 +1,28 @@
+CREATE TABLE managers_totp
+(
+    manager_id BIGINT PRIMARY KEY REFERENCES managers,
+    secret     TEXT      NOT NULL,
+    enabled    BOOLEAN   NOT NULL DEFAULT FALSE,
+    last_step  BIGINT    NOT NULL DEFAULT 0,
+    created    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE managers_recovery_codes
+(
+    id         BIGSERIAL PRIMARY KEY,
+    manager_id BIGINT    NOT NULL REFERENCES managers,
+    code_hash  TEXT      NOT NULL,
+    used       TIMESTAMP,
+    created    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE mfa_challenges
+(
+    id         BIGSERIAL PRIMARY KEY,
+    token_hash TEXT      NOT NULL UNIQUE,
+    manager_id BIGINT    NOT NULL REFERENCES managers,
+    attempts   INTEGER   NOT NULL DEFAULT 0,
+    expire     TIMESTAMP NOT NULL,
+    used       TIMESTAMP,
+    created    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
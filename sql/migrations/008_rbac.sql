@@ -0,0 +1,65 @@
+CREATE TABLE roles
+(
+    id          BIGSERIAL PRIMARY KEY,
+    name        TEXT      NOT NULL UNIQUE,
+    description TEXT      NOT NULL DEFAULT '',
+    created     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE permissions
+(
+    id          BIGSERIAL PRIMARY KEY,
+    name        TEXT NOT NULL UNIQUE,
+    description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE role_permissions
+(
+    role_id       BIGINT NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission_id BIGINT NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+INSERT INTO permissions(name, description)
+VALUES ('products:read', 'просмотр товаров'),
+       ('products:write', 'добавление и изменение товаров'),
+       ('products:delete', 'удаление товаров'),
+       ('customers:read', 'просмотр покупателей'),
+       ('customers:write', 'добавление и изменение покупателей'),
+       ('customers:delete', 'удаление покупателей'),
+       ('sales:read', 'просмотр своих продаж'),
+       ('sales:read:all', 'просмотр продаж всех менеджеров'),
+       ('sales:write', 'оформление продаж'),
+       ('sales:price_override', 'продажа по цене, отличной от цены товара'),
+       ('managers:read', 'просмотр менеджеров'),
+       ('managers:write', 'регистрация и изменение менеджеров'),
+       ('sessions:revoke', 'завершение сессий других пользователей'),
+       ('lockouts:read', 'просмотр блокировок входа'),
+       ('roles:read', 'просмотр ролей и прав'),
+       ('roles:write', 'управление ролями и их назначение');
+
+INSERT INTO roles(name, description)
+VALUES ('ADMIN', 'все права'),
+       ('MANAGER', 'работа с покупателями и продажами'),
+       ('PRICE_OVERRIDE', 'изменение цены при продаже');
+
+INSERT INTO role_permissions(role_id, permission_id)
+SELECT r.id, p.id FROM roles r, permissions p WHERE r.name = 'ADMIN';
+
+INSERT INTO role_permissions(role_id, permission_id)
+SELECT r.id, p.id FROM roles r, permissions p
+WHERE r.name = 'MANAGER'
+  AND p.name IN ('products:read', 'customers:read', 'customers:write', 'sales:read', 'sales:write');
+
+INSERT INTO role_permissions(role_id, permission_id)
+SELECT r.id, p.id FROM roles r, permissions p WHERE r.name = 'PRICE_OVERRIDE' AND p.name = 'sales:price_override';
+
+ALTER TABLE managers ALTER COLUMN roles SET DEFAULT '{MANAGER}';
+
+-- до появления прав у менеджера без ролей был доступ к продажам, товарам и покупателям
+UPDATE managers SET roles = '{MANAGER}' WHERE roles = '{}';
+
+-- роли, которые уже назначены менеджерам, попадают в справочник без прав
+INSERT INTO roles(name)
+SELECT DISTINCT unnest(roles) FROM managers
+ON CONFLICT (name) DO NOTHING;
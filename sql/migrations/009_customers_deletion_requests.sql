@@ -0,0 +1,11 @@
+CREATE TABLE customers_deletion_requests
+(
+    id          BIGSERIAL PRIMARY KEY,
+    customer_id BIGINT    NOT NULL REFERENCES customers ON DELETE CASCADE,
+    reason      TEXT      NOT NULL DEFAULT '',
+    status      TEXT      NOT NULL DEFAULT 'pending' CHECK ( status IN ('pending', 'cancelled', 'completed') ),
+    created     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    processed   TIMESTAMP
+);
+
+CREATE UNIQUE INDEX customers_deletion_requests_pending_idx ON customers_deletion_requests (customer_id) WHERE status = 'pending';
@@ -0,0 +1,19 @@
+CREATE TABLE otp_codes
+(
+    id        BIGSERIAL PRIMARY KEY,
+    kind      TEXT      NOT NULL,
+    purpose   TEXT      NOT NULL,
+    phone     TEXT      NOT NULL,
+    owner_id  BIGINT    NOT NULL,
+    code_hash TEXT      NOT NULL,
+    attempts  INTEGER   NOT NULL DEFAULT 0,
+    expire    TIMESTAMP NOT NULL,
+    used      TIMESTAMP,
+    created   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX otp_codes_phone_idx ON otp_codes (kind, purpose, phone, created);
+
+-- номера уже зарегистрированных покупателей считаются подтверждёнными
+ALTER TABLE customers ADD COLUMN phone_verified BOOLEAN NOT NULL DEFAULT FALSE;
+UPDATE customers SET phone_verified = TRUE;
@@ -0,0 +1,10 @@
+CREATE TABLE password_history
+(
+    id       BIGSERIAL PRIMARY KEY,
+    kind     TEXT      NOT NULL,
+    owner_id BIGINT    NOT NULL,
+    hash     TEXT      NOT NULL,
+    created  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX password_history_owner_idx ON password_history (kind, owner_id, created);
@@ -0,0 +1,24 @@
+CREATE TABLE api_keys
+(
+    id          BIGSERIAL PRIMARY KEY,
+    name        TEXT      NOT NULL,
+    manager_id  BIGINT    NOT NULL REFERENCES managers,
+    prefix      TEXT      NOT NULL,
+    key_hash    TEXT      NOT NULL UNIQUE,
+    scopes      TEXT[]    NOT NULL DEFAULT '{}',
+    allowed_ips TEXT[]    NOT NULL DEFAULT '{}',
+    expire      TIMESTAMP,
+    last_used   TIMESTAMP,
+    last_ip     TEXT      NOT NULL DEFAULT '',
+    revoked     TIMESTAMP,
+    created     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO permissions(name, description)
+VALUES ('api_keys:read', 'просмотр API-ключей'),
+       ('api_keys:write', 'выпуск и отзыв API-ключей');
+
+INSERT INTO role_permissions(role_id, permission_id)
+SELECT r.id, p.id FROM roles r, permissions p
+WHERE r.name = 'ADMIN'
+  AND p.name IN ('api_keys:read', 'api_keys:write');
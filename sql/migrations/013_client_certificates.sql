@@ -0,0 +1,13 @@
+CREATE TABLE client_certificates
+(
+    id         BIGSERIAL PRIMARY KEY,
+    subject    TEXT      NOT NULL,
+    manager_id BIGINT REFERENCES managers,
+    api_key_id BIGINT REFERENCES api_keys,
+    last_used  TIMESTAMP,
+    revoked    TIMESTAMP,
+    created    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CHECK ( (manager_id IS NULL) <> (api_key_id IS NULL) )
+);
+
+CREATE UNIQUE INDEX client_certificates_subject_idx ON client_certificates (subject) WHERE revoked IS NULL;
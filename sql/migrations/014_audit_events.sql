@@ -0,0 +1,44 @@
+CREATE TABLE audit_events
+(
+    id          BIGSERIAL PRIMARY KEY,
+    actor_kind  TEXT      NOT NULL DEFAULT '',
+    actor_id    BIGINT,
+    action      TEXT      NOT NULL,
+    target_kind TEXT      NOT NULL DEFAULT '',
+    target_id   TEXT      NOT NULL DEFAULT '',
+    ip          TEXT      NOT NULL DEFAULT '',
+    user_agent  TEXT      NOT NULL DEFAULT '',
+    outcome     TEXT      NOT NULL,
+    details     TEXT      NOT NULL DEFAULT '',
+    created     TIMESTAMP NOT NULL,
+    prev_hash   TEXT      NOT NULL,
+    hash        TEXT      NOT NULL UNIQUE
+);
+
+CREATE INDEX audit_events_actor_idx ON audit_events (actor_kind, actor_id);
+CREATE INDEX audit_events_target_idx ON audit_events (target_kind, target_id);
+CREATE INDEX audit_events_created_idx ON audit_events (created);
+
+-- журнал только дополняется
+CREATE FUNCTION audit_events_append_only() RETURNS trigger AS
+$$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_events_append_only
+    BEFORE UPDATE OR DELETE ON audit_events
+    FOR EACH ROW EXECUTE PROCEDURE audit_events_append_only();
+
+CREATE TRIGGER audit_events_no_truncate
+    BEFORE TRUNCATE ON audit_events
+    FOR EACH STATEMENT EXECUTE PROCEDURE audit_events_append_only();
+
+INSERT INTO permissions(name, description)
+VALUES ('audit:read', 'просмотр журнала аудита');
+
+INSERT INTO role_permissions(role_id, permission_id)
+SELECT r.id, p.id FROM roles r, permissions p
+WHERE r.name = 'ADMIN'
+  AND p.name = 'audit:read';
@@ -0,0 +1,9 @@
+-- Причина и срок блокировки покупателей и менеджеров.
+-- blocked_until IS NULL у заблокированного - бессрочная блокировка
+ALTER TABLE customers
+    ADD COLUMN blocked_reason TEXT NOT NULL DEFAULT '',
+    ADD COLUMN blocked_until  TIMESTAMP;
+
+ALTER TABLE managers
+    ADD COLUMN blocked_reason TEXT NOT NULL DEFAULT '',
+    ADD COLUMN blocked_until  TIMESTAMP;
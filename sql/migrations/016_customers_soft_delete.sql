@@ -0,0 +1,3 @@
+-- Покупатели с продажами не удаляются, а помечаются удалёнными
+ALTER TABLE customers
+    ADD COLUMN deleted TIMESTAMP;
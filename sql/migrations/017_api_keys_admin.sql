@@ -0,0 +1,8 @@
+-- Выпустить ключ от имени другого менеджера может только администратор ключей
+INSERT INTO permissions(name, description)
+VALUES ('api_keys:admin', 'выпуск API-ключей от имени других менеджеров');
+
+INSERT INTO role_permissions(role_id, permission_id)
+SELECT r.id, p.id FROM roles r, permissions p
+WHERE r.name = 'ADMIN'
+  AND p.name = 'api_keys:admin';
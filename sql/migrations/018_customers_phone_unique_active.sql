@@ -0,0 +1,5 @@
+-- Номер покупателя, помеченного удалённым, освобождается для новой регистрации
+ALTER TABLE customers
+    DROP CONSTRAINT customers_phone_key;
+
+CREATE UNIQUE INDEX customers_phone_idx ON customers (phone) WHERE deleted IS NULL;
@@ -0,0 +1,7 @@
+-- jti подписанного access-токена: при отзыве сессии он попадает в список отозванных JWT,
+-- который сервер проверяет без обращения к базе
+ALTER TABLE customers_tokens
+    ADD COLUMN jti TEXT;
+
+ALTER TABLE managers_tokens
+    ADD COLUMN jti TEXT;
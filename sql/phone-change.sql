@@ -1,3 +1,5 @@
+-- номер теперь меняет сам покупатель: POST /api/customers/me/phone и /api/customers/me/phone/confirm
+-- с кодом из SMS. Запрос ниже оставлен для ручных исправлений
 UPDATE customers
 set phone='+992000000011'
 where id = 11 RETURNING  id, name, active;
\ No newline at end of file